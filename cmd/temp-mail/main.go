@@ -1,15 +1,24 @@
 package main
 
 import (
+	"cmp"
 	"context"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"temp_mail/internal/dkimkeys"
+	"temp_mail/internal/domains"
 	"temp_mail/internal/httpapi"
+	"temp_mail/internal/mailauth"
+	"temp_mail/internal/outbound"
 	"temp_mail/internal/smtpclient"
 	"temp_mail/internal/smtpserver"
 	"temp_mail/internal/storage"
@@ -19,26 +28,158 @@ func main() {
 	// Config via env with defaults
 	httpAddr := getenv("HTTP_ADDR", ":8080")
 	smtpAddr := getenv("SMTP_ADDR", ":2525")
-	domain := getenv("DOMAIN", "tmp.local")
+	// DOMAINS 为逗号分隔的域名列表，第一个为默认域名；未设置时沿用 DOMAIN
+	domainList, err := domains.Parse(getenv("DOMAINS", getenv("DOMAIN", "tmp.local")))
+	if err != nil {
+		log.Fatalf("invalid DOMAINS: %v", err)
+	}
+	reg, err := domains.New(domainList...)
+	if err != nil {
+		log.Fatalf("invalid DOMAINS: %v", err)
+	}
+	domain := reg.Default().Name
 	ttlStr := getenv("MESSAGE_TTL", "30m")
 	ttl, err := time.ParseDuration(ttlStr)
 	if err != nil {
 		log.Fatalf("invalid MESSAGE_TTL: %v", err)
 	}
+	addressTTL, err := time.ParseDuration(getenv("ADDRESS_TTL", "24h"))
+	if err != nil || addressTTL <= 0 {
+		log.Fatalf("invalid ADDRESS_TTL: %q", os.Getenv("ADDRESS_TTL"))
+	}
 
-	store := storage.NewMemoryStore(ttl)
+	store, err := openStore(getenv("STORE_DRIVER", "memory"), os.Getenv("STORE_URL"), ttl)
+	if err != nil {
+		log.Fatalf("open store: %v", err)
+	}
+	store.SetAddressTTL(addressTTL)
+	for _, d := range reg.All() {
+		store.SetDomainTTL(d.Name, storage.DomainTTL{Message: d.MessageTTL, Address: d.AddressTTL})
+	}
+	// 旧版本只按本地部分保存邮箱，归入默认域名
+	if q, ok := store.(storage.LegacyQualifier); ok {
+		if err := q.QualifyLegacy(domain); err != nil {
+			log.Fatalf("migrate mailboxes to %s: %v", domain, err)
+		}
+	}
+
+	// 每个邮箱的配额（0 表示不限）以及超限时的处理策略
+	quota, err := loadQuota()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	store.SetQuota(quota)
+	if v := os.Getenv("MEMORY_LIMIT"); v != "" {
+		limit, err := parseSize(v)
+		if err != nil {
+			log.Fatalf("invalid MEMORY_LIMIT: %v", err)
+		}
+		ms, ok := store.(*storage.MemoryStore)
+		if !ok {
+			log.Fatalf("MEMORY_LIMIT only applies to STORE_DRIVER=memory")
+		}
+		ms.SetMemoryLimit(limit)
+	}
 
 	// SMTP客户端配置（用于发送邮件）
 	// 使用本地域名创建发送客户端
 	smtpClient := smtpclient.NewClient(domain)
 	log.Printf("SMTP发送客户端已启用，使用域名: %s", domain)
 
+	// 中继模式：云主机常封禁 25 端口出站，此时经由 smarthost 投递
+	relay, err := loadRelay()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if relay != nil {
+		smtpClient.SetRelay(relay)
+		log.Printf("外发邮件经由中继 %s 投递 (%s, fallback=%v)", relay.Addr, relay.Security, relay.Fallback)
+	}
+
+	// DKIM 签名：每个域名一把密钥，未指定 dkim_key 时首次启动自动生成
+	var dkimKeys *dkimkeys.Keyring
+	if getenv("DKIM_SIGN", "true") == "true" {
+		dkimKeys, err = loadDKIM(reg)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		smtpClient.SetSigner(dkimKeys)
+	}
+
+	// 发送队列：邮件先写入 spool 目录，由后台协程投递并按指数退避重试
+	queueCfg, err := loadQueueConfig()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	outbox, err := outbound.New(queueCfg, smtpClient, store)
+	if err != nil {
+		log.Fatalf("open spool %s: %v", queueCfg.Dir, err)
+	}
+	log.Printf("发送队列 spool 目录: %s", queueCfg.Dir)
+
+	// 开放模式下不校验邮箱令牌（兼容旧版客户端）
+	openMode := getenv("OPEN_MODE", "false") == "true"
+	if openMode {
+		log.Printf("OPEN_MODE 已启用：任何人知道邮箱名即可读取邮件")
+	}
+
 	// HTTP server
-	mux := httpapi.NewMux(store, domain, smtpClient)
+	mux := httpapi.NewMux(store, reg, outbox, httpapi.Options{OpenMode: openMode, DKIM: dkimKeys, SPF: spfRecord(relay)})
 	httpSrv := &http.Server{Addr: httpAddr, Handler: mux}
 
 	// SMTP server
-	smtpSrv := smtpserver.NewServer(store, domain)
+	smtpSrv := smtpserver.NewServer(store, reg)
+	// 收件策略：catch-all（默认）、existing（仅接收已通过 API 创建的邮箱）或 allowlist
+	policy, err := smtpserver.ParseRecipientPolicy(getenv("RECIPIENT_MODE", smtpserver.RecipientsCatchAll), os.Getenv("RECIPIENT_PATTERNS"))
+	if err != nil {
+		log.Fatalf("invalid RECIPIENT_MODE: %v", err)
+	}
+	smtpSrv.SetRecipientPolicy(policy)
+
+	// 连接数、发信频率与超时限制（0 表示不限）
+	limits, err := loadLimits()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	smtpSrv.SetLimits(limits)
+
+	// 灰名单：默认关闭，域名可用 greylist=off 单独豁免
+	if getenv("GREYLIST", "off") == "on" {
+		grey := smtpserver.DefaultGreylist()
+		if v := os.Getenv("GREYLIST_DELAY"); v != "" {
+			if grey.Delay, err = time.ParseDuration(v); err != nil || grey.Delay < 0 {
+				log.Fatalf("invalid GREYLIST_DELAY: %q", v)
+			}
+		}
+		if v := os.Getenv("GREYLIST_EXPIRY"); v != "" {
+			if grey.WhitelistTTL, err = time.ParseDuration(v); err != nil || grey.WhitelistTTL <= 0 {
+				log.Fatalf("invalid GREYLIST_EXPIRY: %q", v)
+			}
+		}
+		smtpSrv.SetGreylist(grey)
+		log.Printf("灰名单已开启: delay=%v, expiry=%v", grey.Delay, grey.WhitelistTTL)
+	}
+
+	// 入站 SPF/DKIM/DMARC 校验，结果写入 Authentication-Results 头
+	if getenv("MAIL_AUTH", "true") == "true" {
+		smtpSrv.SetAuthVerifier(mailauth.NewVerifier(nil))
+	}
+
+	// STARTTLS：未提供证书时在启动时生成自签名证书
+	smtpsAddr := os.Getenv("SMTPS_ADDR")
+	if getenv("SMTP_TLS", "true") == "true" {
+		certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+		tlsConfig, err := smtpserver.LoadTLSConfig(certFile, keyFile, domainNames(reg)...)
+		if err != nil {
+			log.Fatalf("load TLS certificate: %v", err)
+		}
+		if certFile == "" {
+			log.Printf("未配置 TLS_CERT/TLS_KEY，STARTTLS 使用自签名证书")
+		}
+		smtpSrv.SetTLSConfig(tlsConfig)
+	} else if smtpsAddr != "" {
+		log.Fatalf("SMTPS_ADDR requires SMTP_TLS=true")
+	}
 
 	// Run servers
 	go func() {
@@ -49,12 +190,21 @@ func main() {
 	}()
 
 	go func() {
-		log.Printf("SMTP listening on %s for domain %s", smtpAddr, domain)
+		log.Printf("SMTP listening on %s for domains %v", smtpAddr, domainNames(reg))
 		if err := smtpSrv.ListenAndServe(smtpAddr); err != nil {
 			log.Fatalf("smtp server: %v", err)
 		}
 	}()
 
+	if smtpsAddr != "" {
+		go func() {
+			log.Printf("SMTPS listening on %s", smtpsAddr)
+			if err := smtpSrv.ListenAndServeTLS(smtpsAddr); err != nil {
+				log.Fatalf("smtps server: %v", err)
+			}
+		}()
+	}
+
 	// Graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -65,9 +215,225 @@ func main() {
 	defer cancel()
 	_ = httpSrv.Shutdown(ctx)
 	_ = smtpSrv.Shutdown()
+	_ = outbox.Close()
 	store.Close()
 }
 
+// openStore picks the storage.Store implementation selected by STORE_DRIVER.
+func openStore(driver, url string, ttl time.Duration) (storage.Store, error) {
+	switch strings.ToLower(driver) {
+	case "", "memory":
+		return storage.NewMemoryStore(ttl), nil
+	case "sqlite":
+		if url == "" {
+			url = "temp_mail.db"
+		}
+		log.Printf("使用 SQLite 存储: %s", url)
+		return storage.NewSQLiteStore(url, ttl)
+	case "maildir":
+		if url == "" {
+			url = "maildir"
+		}
+		log.Printf("使用 Maildir 存储: %s", url)
+		return storage.NewMaildirStore(url, ttl)
+	default:
+		return nil, fmt.Errorf("unknown STORE_DRIVER %q", driver)
+	}
+}
+
+func loadQuota() (storage.Quota, error) {
+	var q storage.Quota
+	var err error
+	if q.MaxMessages, err = strconv.Atoi(getenv("QUOTA_MESSAGES", "0")); err != nil || q.MaxMessages < 0 {
+		return q, fmt.Errorf("invalid QUOTA_MESSAGES: %q", os.Getenv("QUOTA_MESSAGES"))
+	}
+	if q.MaxBytes, err = parseSize(getenv("QUOTA_BYTES", "0")); err != nil {
+		return q, fmt.Errorf("invalid QUOTA_BYTES: %v", err)
+	}
+	q.Policy = strings.ToLower(getenv("QUOTA_POLICY", storage.QuotaEvict))
+	switch q.Policy {
+	case storage.QuotaEvict, storage.QuotaDefer, storage.QuotaReject:
+	default:
+		return q, fmt.Errorf("invalid QUOTA_POLICY %q (want evict, defer or reject)", q.Policy)
+	}
+	return q, nil
+}
+
+// loadLimits reads the SMTP connection, rate and timeout limits; unset
+// variables keep smtpserver.DefaultLimits and 0 disables a limit.
+func loadLimits() (smtpserver.Limits, error) {
+	l := smtpserver.DefaultLimits()
+	for _, v := range []struct {
+		name string
+		dst  *int
+	}{
+		{"SMTP_MAX_CONNS_PER_IP", &l.MaxConnsPerIP},
+		{"SMTP_RATE_PER_IP", &l.MessagesPerIP},
+		{"SMTP_RATE_PER_RCPT", &l.MessagesPerRcpt},
+		{"SMTP_MAX_RCPTS", &l.MaxRecipients},
+	} {
+		raw := os.Getenv(v.name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return l, fmt.Errorf("invalid %s: %q", v.name, raw)
+		}
+		*v.dst = n
+	}
+	for _, v := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"SMTP_IDLE_TIMEOUT", &l.IdleTimeout},
+		{"SMTP_COMMAND_TIMEOUT", &l.CommandTimeout},
+	} {
+		raw := os.Getenv(v.name)
+		if raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d < 0 {
+			return l, fmt.Errorf("invalid %s: %q", v.name, raw)
+		}
+		*v.dst = d
+	}
+	return l, nil
+}
+
+// loadQueueConfig reads the outbound queue settings.
+func loadQueueConfig() (outbound.Config, error) {
+	cfg := outbound.DefaultConfig(getenv("SPOOL_DIR", "spool"))
+	if v := os.Getenv("QUEUE_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid QUEUE_WORKERS: %q", v)
+		}
+		cfg.Workers = n
+	}
+	for _, v := range []struct {
+		name string
+		dst  *time.Duration
+	}{
+		{"QUEUE_LIFETIME", &cfg.Lifetime},
+		{"QUEUE_BACKOFF", &cfg.Backoff},
+		{"QUEUE_MAX_BACKOFF", &cfg.MaxBackoff},
+	} {
+		raw := os.Getenv(v.name)
+		if raw == "" {
+			continue
+		}
+		d, err := time.ParseDuration(raw)
+		if err != nil || d <= 0 {
+			return cfg, fmt.Errorf("invalid %s: %q", v.name, raw)
+		}
+		*v.dst = d
+	}
+	return cfg, nil
+}
+
+// loadRelay reads the smarthost settings; it returns nil when SMTP_RELAY is
+// unset.
+func loadRelay() (*smtpclient.Relay, error) {
+	addr := os.Getenv("SMTP_RELAY")
+	if addr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid SMTP_RELAY: %q (want host:port)", addr)
+	}
+	r := &smtpclient.Relay{
+		Addr:     addr,
+		Username: os.Getenv("SMTP_RELAY_USER"),
+		Password: os.Getenv("SMTP_RELAY_PASSWORD"),
+		Auth:     strings.ToLower(os.Getenv("SMTP_RELAY_AUTH")),
+		Security: strings.ToLower(getenv("SMTP_RELAY_SECURITY", smtpclient.RelaySTARTTLS)),
+		Fallback: getenv("SMTP_RELAY_FALLBACK", "false") == "true",
+	}
+	switch r.Auth {
+	case "", "plain", "login", "cram-md5":
+	default:
+		return nil, fmt.Errorf("invalid SMTP_RELAY_AUTH: %q (want plain, login or cram-md5)", r.Auth)
+	}
+	switch r.Security {
+	case smtpclient.RelaySTARTTLS, smtpclient.RelayTLS, smtpclient.RelayNone:
+	default:
+		return nil, fmt.Errorf("invalid SMTP_RELAY_SECURITY: %q (want starttls, tls or none)", r.Security)
+	}
+	return r, nil
+}
+
+// spfRecord is the SPF record suggested by /api/domains/{domain}/dns:
+// SPF_RECORD when set, otherwise the MX hosts plus the relay, if any. A relay
+// whose provider publishes an include: record needs SPF_RECORD.
+func spfRecord(relay *smtpclient.Relay) string {
+	if v := os.Getenv("SPF_RECORD"); v != "" {
+		return v
+	}
+	if relay == nil {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(relay.Addr)
+	mech := "a:" + host
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() != nil {
+			mech = "ip4:" + host
+		} else {
+			mech = "ip6:" + host
+		}
+	}
+	return "v=spf1 mx " + mech + " ~all"
+}
+
+// loadDKIM loads or generates the signing key of every domain. Domain
+// settings override DKIM_SELECTOR and DKIM_ALGORITHM.
+func loadDKIM(reg *domains.Registry) (*dkimkeys.Keyring, error) {
+	keys := dkimkeys.NewKeyring(getenv("DKIM_KEY_DIR", "dkim"))
+	selector := getenv("DKIM_SELECTOR", "mail")
+	algorithm := getenv("DKIM_ALGORITHM", dkimkeys.RSA)
+	if algorithm != dkimkeys.RSA && algorithm != dkimkeys.Ed25519 {
+		return nil, fmt.Errorf("invalid DKIM_ALGORITHM: %q (want rsa or ed25519)", algorithm)
+	}
+	for _, d := range reg.All() {
+		k, err := keys.Add(d.Name, cmp.Or(d.DKIMSelector, selector), cmp.Or(d.DKIMAlgorithm, algorithm), d.DKIMKey)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("DKIM 签名已启用: %s (%s)", k.RecordName(), k.Algorithm)
+	}
+	return keys, nil
+}
+
+// parseSize parses a byte count with an optional KB/MB/GB suffix (powers of
+// 1024), e.g. "512KB" or "1GB".
+func parseSize(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", v)
+	}
+	return n * mult, nil
+}
+
+func domainNames(reg *domains.Registry) []string {
+	var names []string
+	for _, d := range reg.All() {
+		names = append(names, d.Name)
+	}
+	return names
+}
+
 func getenv(k, def string) string {
 	if v := os.Getenv(k); v != "" {
 		return v
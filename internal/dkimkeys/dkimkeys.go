@@ -0,0 +1,200 @@
+// Package dkimkeys loads or generates the per-domain DKIM keys used to sign
+// outbound mail and renders the DNS records that go with them.
+package dkimkeys
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// Algorithms.
+const (
+	RSA     = "rsa"     // rsa-sha256, 2048-bit keys
+	Ed25519 = "ed25519" // ed25519-sha256 (RFC 8463)
+)
+
+// signedHeaders are signed, and oversigned when absent, so they cannot be
+// added or altered in transit.
+var signedHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// Key is the DKIM key of one domain.
+type Key struct {
+	Domain    string
+	Selector  string
+	Algorithm string
+	signer    crypto.Signer
+}
+
+// RecordName is the DNS name the public key is published under.
+func (k *Key) RecordName() string {
+	return k.Selector + "._domainkey." + k.Domain
+}
+
+// Record is the TXT value of the public key record.
+func (k *Key) Record() string {
+	der, err := x509.MarshalPKIXPublicKey(k.signer.Public())
+	if err != nil {
+		return ""
+	}
+	if k.Algorithm == Ed25519 {
+		// RFC 8463 publishes the raw 32-byte key, not the SPKI structure.
+		der = k.signer.Public().(ed25519.PublicKey)
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", k.Algorithm, base64.StdEncoding.EncodeToString(der))
+}
+
+// Sign prepends a DKIM-Signature header to raw.
+func (k *Key) Sign(raw []byte) ([]byte, error) {
+	var out bytes.Buffer
+	err := dkim.Sign(&out, bytes.NewReader(raw), &dkim.SignOptions{
+		Domain:                 k.Domain,
+		Selector:               k.Selector,
+		Signer:                 k.signer,
+		Hash:                   crypto.SHA256,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             signedHeaders,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dkim sign for %s: %w", k.Domain, err)
+	}
+	return out.Bytes(), nil
+}
+
+// Keyring maps sending domains to their keys. It is safe for concurrent use.
+type Keyring struct {
+	dir  string
+	mu   sync.RWMutex
+	keys map[string]*Key
+}
+
+// NewKeyring returns an empty keyring that keeps generated keys in dir.
+func NewKeyring(dir string) *Keyring {
+	return &Keyring{dir: dir, keys: make(map[string]*Key)}
+}
+
+// Add registers the key of domain. keyFile is a PEM private key (PKCS#8,
+// PKCS#1 or the OpenSSL ed25519 format); when empty the key is read from,
+// or on first start generated into, <dir>/<domain>.<selector>.pem with the
+// given algorithm.
+func (r *Keyring) Add(domain, selector, algorithm, keyFile string) (*Key, error) {
+	domain = strings.ToLower(domain)
+	if selector == "" {
+		return nil, fmt.Errorf("dkim %s: empty selector", domain)
+	}
+	var (
+		signer crypto.Signer
+		err    error
+	)
+	if keyFile != "" {
+		signer, err = readKey(keyFile)
+	} else {
+		keyFile = filepath.Join(r.dir, domain+"."+selector+".pem")
+		signer, err = readKey(keyFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			signer, err = generate(keyFile, algorithm)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("dkim %s: %w", domain, err)
+	}
+	k := &Key{Domain: domain, Selector: selector, Algorithm: RSA, signer: signer}
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		k.Algorithm = Ed25519
+	}
+	r.mu.Lock()
+	r.keys[domain] = k
+	r.mu.Unlock()
+	return k, nil
+}
+
+// Lookup returns the key of domain.
+func (r *Keyring) Lookup(domain string) (*Key, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	k, ok := r.keys[strings.ToLower(domain)]
+	return k, ok
+}
+
+// Sign signs raw with the key of domain and returns raw unchanged when the
+// domain has none.
+func (r *Keyring) Sign(domain string, raw []byte) ([]byte, error) {
+	k, ok := r.Lookup(domain)
+	if !ok {
+		return raw, nil
+	}
+	return k.Sign(raw)
+}
+
+func readKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block", path)
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("%s: unsupported key type %T", path, k)
+}
+
+func generate(path, algorithm string) (crypto.Signer, error) {
+	var (
+		signer crypto.Signer
+		err    error
+	)
+	switch algorithm {
+	case "", RSA:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case Ed25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown algorithm %q (want rsa or ed25519)", algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
@@ -0,0 +1,75 @@
+package dkimkeys
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@example.net\r\n" +
+	"Subject: hi\r\n" +
+	"Date: Mon, 02 Jan 2006 15:04:05 +0000\r\n" +
+	"\r\n" +
+	"hello\r\n"
+
+func TestKeyring_GenerateSignVerify(t *testing.T) {
+	for _, alg := range []string{RSA, Ed25519} {
+		t.Run(alg, func(t *testing.T) {
+			dir := t.TempDir()
+			keys := NewKeyring(dir)
+			k, err := keys.Add("Example.com", "s1", alg, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.Algorithm != alg || k.RecordName() != "s1._domainkey.example.com" {
+				t.Fatalf("key %+v", k)
+			}
+			path := filepath.Join(dir, "example.com.s1.pem")
+			if _, err := os.Stat(path); err != nil {
+				t.Fatalf("key not written: %v", err)
+			}
+
+			signed, err := keys.Sign("EXAMPLE.COM", []byte(testMessage))
+			if err != nil {
+				t.Fatal(err)
+			}
+			lookup := func(name string) ([]string, error) {
+				if name != k.RecordName() {
+					return nil, fmt.Errorf("no record %s", name)
+				}
+				return []string{k.Record()}, nil
+			}
+			verifs, err := dkim.VerifyWithOptions(bytes.NewReader(signed), &dkim.VerifyOptions{LookupTXT: lookup})
+			if err != nil || len(verifs) != 1 || verifs[0].Err != nil || verifs[0].Domain != "example.com" {
+				t.Fatalf("verify: %v %+v", err, verifs)
+			}
+
+			// A restart reuses the stored key instead of generating a new one.
+			again, err := NewKeyring(dir).Add("example.com", "s1", RSA, "")
+			if err != nil || again.Record() != k.Record() {
+				t.Fatalf("reload: %v, record changed", err)
+			}
+			// So does an explicit key file.
+			explicit, err := NewKeyring(t.TempDir()).Add("example.com", "s1", "", path)
+			if err != nil || explicit.Record() != k.Record() {
+				t.Fatalf("key file: %v, record changed", err)
+			}
+		})
+	}
+}
+
+func TestKeyring_UnknownDomain(t *testing.T) {
+	keys := NewKeyring(t.TempDir())
+	out, err := keys.Sign("example.org", []byte(testMessage))
+	if err != nil || string(out) != testMessage {
+		t.Fatalf("unsigned domain altered: %v", err)
+	}
+	if _, err := keys.Add("example.org", "s1", "dsa", ""); err == nil {
+		t.Fatal("expected an error for an unknown algorithm")
+	}
+}
@@ -0,0 +1,147 @@
+// Package domains holds the set of mail domains an instance serves and the
+// settings each of them carries.
+package domains
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Domain is one served mail domain. Zero TTLs mean the store defaults.
+type Domain struct {
+	Name string
+	// MessageTTL is how long messages to this domain are kept.
+	MessageTTL time.Duration
+	// AddressTTL is the lifetime of mailboxes on this domain.
+	AddressTTL time.Duration
+	// Closed stops the HTTP API from handing out new mailboxes on this
+	// domain; existing ones stay usable by their token holders.
+	Closed bool
+	// NoGreylist exempts the domain's recipients from SMTP greylisting.
+	NoGreylist bool
+	// DKIMSelector, DKIMKey and DKIMAlgorithm override the global DKIM
+	// signing settings for mail sent from this domain.
+	DKIMSelector  string
+	DKIMKey       string
+	DKIMAlgorithm string
+}
+
+// Registry is an immutable, ordered domain list. The first domain is the
+// default one.
+type Registry struct {
+	list   []Domain
+	byName map[string]Domain
+}
+
+// New builds a registry. Names are matched case-insensitively.
+func New(list ...Domain) (*Registry, error) {
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no domains configured")
+	}
+	r := &Registry{byName: make(map[string]Domain, len(list))}
+	for _, d := range list {
+		d.Name = strings.ToLower(strings.TrimSpace(d.Name))
+		if d.Name == "" {
+			return nil, fmt.Errorf("empty domain name")
+		}
+		if _, dup := r.byName[d.Name]; dup {
+			return nil, fmt.Errorf("domain %s listed twice", d.Name)
+		}
+		r.byName[d.Name] = d
+		r.list = append(r.list, d)
+	}
+	return r, nil
+}
+
+// Parse reads a comma separated domain list in which every entry may carry
+// settings as a query string:
+//
+//	tmp.example.com,vanity.io?ttl=1h&address_ttl=6h&registration=closed&greylist=off
+//
+// ttl is the message TTL, address_ttl the mailbox lifetime, registration
+// is open (default) or closed and greylist is on (default) or off.
+// dkim_selector, dkim_key (a PEM file) and dkim_algorithm (rsa or ed25519)
+// set the domain's DKIM signing key.
+func Parse(spec string) ([]Domain, error) {
+	var out []Domain
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, query, _ := strings.Cut(entry, "?")
+		d := Domain{Name: name}
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("domain %s: %v", name, err)
+		}
+		for k := range q {
+			v := q.Get(k)
+			switch k {
+			case "ttl", "address_ttl":
+				ttl, err := time.ParseDuration(v)
+				if err != nil || ttl <= 0 {
+					return nil, fmt.Errorf("domain %s: invalid %s %q", name, k, v)
+				}
+				if k == "ttl" {
+					d.MessageTTL = ttl
+				} else {
+					d.AddressTTL = ttl
+				}
+			case "greylist":
+				switch v {
+				case "on":
+				case "off":
+					d.NoGreylist = true
+				default:
+					return nil, fmt.Errorf("domain %s: greylist must be on or off, got %q", name, v)
+				}
+			case "dkim_selector":
+				d.DKIMSelector = v
+			case "dkim_key":
+				d.DKIMKey = v
+			case "dkim_algorithm":
+				if v != "rsa" && v != "ed25519" {
+					return nil, fmt.Errorf("domain %s: dkim_algorithm must be rsa or ed25519, got %q", name, v)
+				}
+				d.DKIMAlgorithm = v
+			case "registration":
+				switch v {
+				case "open":
+				case "closed":
+					d.Closed = true
+				default:
+					return nil, fmt.Errorf("domain %s: registration must be open or closed, got %q", name, v)
+				}
+			default:
+				return nil, fmt.Errorf("domain %s: unknown setting %q", name, k)
+			}
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+// Default returns the first domain.
+func (r *Registry) Default() Domain { return r.list[0] }
+
+// Lookup finds a domain by name.
+func (r *Registry) Lookup(name string) (Domain, bool) {
+	d, ok := r.byName[strings.ToLower(name)]
+	return d, ok
+}
+
+// All returns the domains in configuration order.
+func (r *Registry) All() []Domain { return append([]Domain(nil), r.list...) }
+
+// Split breaks a mailbox address into local part and lower-cased domain.
+// Addresses without a domain get the default one.
+func (r *Registry) Split(addr string) (local, domain string) {
+	local, domain, ok := strings.Cut(addr, "@")
+	if !ok || domain == "" {
+		return local, r.Default().Name
+	}
+	return local, strings.ToLower(domain)
+}
@@ -0,0 +1,38 @@
+package domains
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	list, err := Parse("Tmp.Example.com, vanity.io?ttl=1h&address_ttl=6h&registration=closed&greylist=off&dkim_selector=s1&dkim_algorithm=ed25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg, err := New(list...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.Default().Name != "tmp.example.com" {
+		t.Fatalf("default %q", reg.Default().Name)
+	}
+	v, ok := reg.Lookup("VANITY.io")
+	if !ok || v.MessageTTL != time.Hour || v.AddressTTL != 6*time.Hour || !v.Closed || !v.NoGreylist ||
+		v.DKIMSelector != "s1" || v.DKIMAlgorithm != "ed25519" {
+		t.Fatalf("vanity.io: %+v %v", v, ok)
+	}
+	if local, dom := reg.Split("bob"); local != "bob" || dom != "tmp.example.com" {
+		t.Fatalf("split bare local: %s %s", local, dom)
+	}
+
+	for _, bad := range []string{"", "a.com?ttl=soon", "a.com?registration=maybe", "a.com?greylist=1", "a.com?dkim_algorithm=dsa", "a.com?color=red", "a.com,A.com"} {
+		list, err := Parse(bad)
+		if err == nil {
+			_, err = New(list...)
+		}
+		if err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
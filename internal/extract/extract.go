@@ -0,0 +1,193 @@
+// Package extract pulls the things people actually open a temp inbox for —
+// one-time codes and confirmation links — out of a parsed message.
+package extract
+
+import (
+	"html"
+	"regexp"
+	"sort"
+	"strings"
+
+	"temp_mail/internal/mimeparse"
+)
+
+// Link kinds. KindOther is used when no keyword matched.
+const (
+	KindVerify      = "verify"
+	KindLogin       = "login"
+	KindReset       = "reset"
+	KindUnsubscribe = "unsubscribe"
+	KindOther       = "other"
+)
+
+// Result is the extraction output embedded in the message JSON.
+type Result struct {
+	// Codes are candidate one-time codes, most likely first.
+	Codes []string `json:"codes"`
+	Links []Link   `json:"links"`
+}
+
+// Link is one http(s) link found in the text or HTML body.
+type Link struct {
+	URL  string `json:"url"`
+	Text string `json:"text,omitempty"`
+	Kind string `json:"kind"`
+}
+
+var (
+	anchorRe = regexp.MustCompile(`(?is)<a\s[^>]*?href\s*=\s*["']([^"']+)["'][^>]*>(.*?)</a>`)
+	urlRe    = regexp.MustCompile(`https?://[^\s<>"'()\[\]{}]+`)
+
+	// Candidates: 4–8 digits, 3+3 digits split by a dash or space, or a
+	// 6–10 character upper-case token mixing letters and digits.
+	numericRe = regexp.MustCompile(`\b\d{4,8}\b|\b\d{3}[- ]\d{3}\b`)
+	alnumRe   = regexp.MustCompile(`\b[A-Z0-9]{6,10}\b`)
+	yearRe    = regexp.MustCompile(`^(19|20)\d\d$`)
+	keywordRe = regexp.MustCompile(`(?i)code|otp|one[- ]time|verif|passcode|pin\b|token|验证码|校验码|动态码|確認コード|認証コード|인증`)
+)
+
+var linkKinds = []struct {
+	kind     string
+	keywords []string
+}{
+	// Order matters: "unsubscribe" often sits next to "confirm" in footers,
+	// and reset links usually say "verify" as well.
+	{KindUnsubscribe, []string{"unsubscribe", "opt-out", "optout", "opt_out", "退订", "取消订阅", "配信停止"}},
+	{KindReset, []string{"reset", "password", "forgot", "recover", "重置", "找回密码", "パスワード"}},
+	{KindVerify, []string{"verify", "verification", "confirm", "activate", "validate", "验证", "确认", "激活", "認証", "確認"}},
+	{KindLogin, []string{"login", "log-in", "signin", "sign-in", "sign_in", "magic", "登录", "ログイン"}},
+}
+
+// FromMessage extracts codes and links from a parsed message. If custom is
+// not nil it replaces the built-in code heuristics; its first capture group
+// is used when it has one.
+func FromMessage(root *mimeparse.Part, custom *regexp.Regexp) Result {
+	return FromBodies(root.Text(), root.HTML(), custom)
+}
+
+// FromBodies is FromMessage for already decoded text and HTML bodies.
+func FromBodies(text, htmlBody string, custom *regexp.Regexp) Result {
+	res := Result{Codes: []string{}, Links: []Link{}}
+	res.Links = links(text, htmlBody)
+
+	plain := text
+	if strings.TrimSpace(plain) == "" {
+		plain = mimeparse.StripHTML(htmlBody)
+	}
+	// URLs are full of digits that are never the code.
+	plain = urlRe.ReplaceAllString(plain, " ")
+	if custom != nil {
+		res.Codes = customCodes(plain, custom)
+	} else {
+		res.Codes = codes(plain)
+	}
+	return res
+}
+
+func customCodes(s string, re *regexp.Regexp) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, m := range re.FindAllStringSubmatch(s, -1) {
+		c := m[0]
+		if len(m) > 1 && m[1] != "" {
+			c = m[1]
+		}
+		if !seen[c] {
+			seen[c] = true
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+func codes(s string) []string {
+	type candidate struct {
+		code string
+		pos  int
+		near bool
+	}
+	var cands []candidate
+	kws := keywordRe.FindAllStringIndex(s, -1)
+	nearKeyword := func(start, end int) bool {
+		for _, k := range kws {
+			// The code usually follows its label ("Your code: 123456"), but
+			// "123456 is your code" is common too.
+			if (start >= k[1] && start-k[1] <= 40) || (k[0] >= end && k[0]-end <= 15) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, loc := range numericRe.FindAllStringIndex(s, -1) {
+		c := strings.NewReplacer("-", "", " ", "").Replace(s[loc[0]:loc[1]])
+		near := nearKeyword(loc[0], loc[1])
+		if yearRe.MatchString(c) && !near {
+			continue
+		}
+		cands = append(cands, candidate{c, loc[0], near})
+	}
+	for _, loc := range alnumRe.FindAllStringIndex(s, -1) {
+		c := s[loc[0]:loc[1]]
+		if !strings.ContainsAny(c, "0123456789") || !strings.ContainsAny(c, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			continue
+		}
+		cands = append(cands, candidate{c, loc[0], nearKeyword(loc[0], loc[1])})
+	}
+
+	// Codes next to a keyword first, then the rest, each in document order.
+	sort.SliceStable(cands, func(i, j int) bool {
+		if cands[i].near != cands[j].near {
+			return cands[i].near
+		}
+		return cands[i].pos < cands[j].pos
+	})
+	out := []string{}
+	seen := map[string]bool{}
+	for _, c := range cands {
+		if !seen[c.code] {
+			seen[c.code] = true
+			out = append(out, c.code)
+		}
+	}
+	return out
+}
+
+func links(text, htmlBody string) []Link {
+	out := []Link{}
+	seen := map[string]bool{}
+	add := func(u, label string) {
+		u = strings.TrimRight(html.UnescapeString(strings.TrimSpace(u)), ".,;:!?")
+		lower := strings.ToLower(u)
+		if !strings.HasPrefix(lower, "http://") && !strings.HasPrefix(lower, "https://") {
+			return
+		}
+		if seen[u] {
+			return
+		}
+		seen[u] = true
+		out = append(out, Link{URL: u, Text: label, Kind: classify(u, label)})
+	}
+	for _, m := range anchorRe.FindAllStringSubmatch(htmlBody, -1) {
+		label := strings.Join(strings.Fields(mimeparse.StripHTML(m[2])), " ")
+		add(m[1], label)
+	}
+	// Bare URLs count in both bodies, so HTML-only mail loses none.
+	for _, body := range []string{text, mimeparse.StripHTML(htmlBody)} {
+		for _, u := range urlRe.FindAllString(body, -1) {
+			add(u, "")
+		}
+	}
+	return out
+}
+
+func classify(u, label string) string {
+	hay := strings.ToLower(u + " " + label)
+	for _, k := range linkKinds {
+		for _, kw := range k.keywords {
+			if strings.Contains(hay, kw) {
+				return k.kind
+			}
+		}
+	}
+	return KindOther
+}
@@ -0,0 +1,56 @@
+package extract
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestFromBodies_CodesAndLinks(t *testing.T) {
+	text := "Welcome to Example 2024!\n" +
+		"Order 88812345 has shipped.\n" +
+		"Your verification code is 482-913.\n" +
+		"Or open https://example.com/verify?token=abc123&uid=7.\n"
+	htmlBody := `<p>Forgot it? <a href="https://example.com/reset?t=1&amp;u=2">Reset password</a></p>` +
+		`<p><a href='https://example.com/l/9'>Unsubscribe</a> | <a href="mailto:help@example.com">help</a></p>`
+
+	res := FromBodies(text, htmlBody, nil)
+	if want := []string{"482913", "88812345"}; !reflect.DeepEqual(res.Codes, want) {
+		t.Fatalf("codes = %v, want %v", res.Codes, want)
+	}
+	want := []Link{
+		{URL: "https://example.com/reset?t=1&u=2", Text: "Reset password", Kind: KindReset},
+		{URL: "https://example.com/l/9", Text: "Unsubscribe", Kind: KindUnsubscribe},
+		{URL: "https://example.com/verify?token=abc123&uid=7", Kind: KindVerify},
+	}
+	if !reflect.DeepEqual(res.Links, want) {
+		t.Fatalf("links = %+v", res.Links)
+	}
+}
+
+func TestFromBodies_CustomPattern(t *testing.T) {
+	res := FromBodies("Ref ABC-1234, token XY-99", "", regexp.MustCompile(`XY-(\d+)`))
+	if want := []string{"99"}; !reflect.DeepEqual(res.Codes, want) {
+		t.Fatalf("codes = %v, want %v", res.Codes, want)
+	}
+}
+
+func TestFromBodies_ChineseOTP(t *testing.T) {
+	res := FromBodies("", "<p>您的验证码为：<b>A7K9Q2</b>，5分钟内有效。</p>", nil)
+	if len(res.Codes) == 0 || res.Codes[0] != "A7K9Q2" {
+		t.Fatalf("codes = %v", res.Codes)
+	}
+}
+
+func TestFromBodies_HTMLOnlyBareURL(t *testing.T) {
+	htmlBody := `<p>Confirm your account: https://example.com/confirm?k=1&amp;u=2</p>` +
+		`<p><a href="https://example.com/login">https://example.com/login</a></p>`
+	res := FromBodies("", htmlBody, nil)
+	want := []Link{
+		{URL: "https://example.com/login", Text: "https://example.com/login", Kind: KindLogin},
+		{URL: "https://example.com/confirm?k=1&u=2", Kind: KindVerify},
+	}
+	if !reflect.DeepEqual(res.Links, want) {
+		t.Fatalf("links = %+v", res.Links)
+	}
+}
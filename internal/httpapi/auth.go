@@ -0,0 +1,58 @@
+package httpapi
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"temp_mail/internal/dkimkeys"
+	"temp_mail/internal/storage"
+)
+
+// tokenHeader carries the mailbox token; Authorization: Bearer and the token
+// query parameter (for links and EventSource) work as well.
+const tokenHeader = "X-Mailbox-Token"
+
+// Options tunes NewMux.
+type Options struct {
+	// OpenMode disables mailbox tokens: anyone who knows an address can
+	// read it, as before tokens existed.
+	OpenMode bool
+	// DKIM holds the signing keys published by /api/domains/{domain}/dns;
+	// nil when outbound signing is off.
+	DKIM *dkimkeys.Keyring
+	// SPF is the SPF record published by /api/domains/{domain}/dns; empty
+	// means "v=spf1 mx ~all". It must cover the relay when one is used.
+	SPF string
+}
+
+func requestToken(r *http.Request) string {
+	if t := r.Header.Get(tokenHeader); t != "" {
+		return t
+	}
+	if h := r.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return r.URL.Query().Get("token")
+}
+
+// authorized reports whether r may access mailbox (a full address). Unknown
+// mailboxes are refused like a wrong token so callers cannot probe which
+// addresses exist.
+func authorized(store storage.Store, opts Options, mailbox string, r *http.Request) bool {
+	if opts.OpenMode {
+		return true
+	}
+	a, ok := store.GetAddress(mailbox)
+	if !ok || a.Token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(a.Token), []byte(requestToken(r))) == 1
+}
+
+func writeUnauthorized(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusUnauthorized)
+	writeJSON(w, map[string]interface{}{
+		"error": "需要有效的邮箱令牌（X-Mailbox-Token 请求头或 token 参数）",
+	})
+}
@@ -0,0 +1,55 @@
+package httpapi
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+
+	"temp_mail/internal/dkimkeys"
+)
+
+// dnsRecord is one record a domain owner should publish.
+type dnsRecord struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Purpose string `json:"purpose"`
+}
+
+// defaultSPF authorizes the domain's MX hosts, which is where mail is sent
+// from when there is no relay.
+const defaultSPF = "v=spf1 mx ~all"
+
+// dnsRecords lists the TXT records that let receivers authenticate mail sent
+// from domain: SPF (spf, or defaultSPF when empty), the DKIM public key when
+// keys has one, and DMARC.
+func dnsRecords(domain, spf string, keys *dkimkeys.Keyring) []dnsRecord {
+	out := []dnsRecord{{
+		Type: "TXT", Name: domain, Value: cmp.Or(spf, defaultSPF), Purpose: "spf",
+	}}
+	if keys != nil {
+		if k, ok := keys.Lookup(domain); ok {
+			out = append(out, dnsRecord{Type: "TXT", Name: k.RecordName(), Value: k.Record(), Purpose: "dkim"})
+		}
+	}
+	out = append(out, dnsRecord{
+		Type: "TXT", Name: "_dmarc." + domain, Value: "v=DMARC1; p=none; adkim=r; aspf=r", Purpose: "dmarc",
+	})
+	return out
+}
+
+// zoneFile renders records as BIND zone lines. TXT values are split into
+// quoted strings of at most 255 bytes, as a 2048-bit DKIM key needs.
+func zoneFile(records []dnsRecord) string {
+	var b strings.Builder
+	for _, rec := range records {
+		var chunks []string
+		for v := rec.Value; v != ""; {
+			n := min(len(v), 255)
+			chunks = append(chunks, `"`+v[:n]+`"`)
+			v = v[n:]
+		}
+		fmt.Fprintf(&b, "%s.\tIN\t%s\t%s\n", rec.Name, rec.Type, strings.Join(chunks, " "))
+	}
+	return b.String()
+}
@@ -1,22 +1,35 @@
 package httpapi
 
 import (
-	"bytes"
+	"cmp"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"mime"
 	"net/http"
 	stdmail "net/mail"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"temp_mail/internal/domains"
+	"temp_mail/internal/extract"
+	"temp_mail/internal/mailauth"
+	"temp_mail/internal/mimeparse"
+	"temp_mail/internal/outbound"
 	"temp_mail/internal/smtpclient"
 	"temp_mail/internal/storage"
 )
 
-func NewMux(store storage.Store, domain string, smtpClient *smtpclient.Client) http.Handler {
+// NewMux builds the API and web UI. outbox queues mail from /api/send; when
+// it is nil sending is disabled.
+func NewMux(store storage.Store, reg *domains.Registry, outbox *outbound.Queue, opts Options) http.Handler {
 	mux := http.NewServeMux()
 
 	// Static files
@@ -26,39 +39,226 @@ func NewMux(store storage.Store, domain string, smtpClient *smtpclient.Client) h
 	mux.HandleFunc("/api/address", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
-			local := r.URL.Query().Get("local")
+			// local may also be a full address; ?domain= picks the domain
+			// otherwise, defaulting to the first configured one.
+			q := r.URL.Query()
+			local, dom := reg.Split(q.Get("local"))
+			if v := q.Get("domain"); v != "" {
+				dom = strings.ToLower(v)
+			}
+			d, ok := reg.Lookup(dom)
+			if !ok {
+				w.WriteHeader(http.StatusBadRequest)
+				writeJSON(w, map[string]interface{}{
+					"error": fmt.Sprintf("不支持的域名: %s", dom),
+				})
+				return
+			}
 			local = sanitizeLocal(local)
-			created := store.CreateAddress(local)
-			writeJSON(w, map[string]interface{}{
-				"address": fmt.Sprintf("%s@%s", created, domain),
-				"local":   created,
-				"ttl":     int(store.TTL().Minutes()),
-			})
+			addr := local + "@" + d.Name
+			exists := local != "" && store.AddressExists(addr)
+			// An existing mailbox is only handed out again to its owner, or
+			// once to whoever claims it first if incoming mail created it.
+			if exists && !authorized(store, opts, addr, r) {
+				if claimed, ok := store.ClaimAddress(addr); ok {
+					writeJSON(w, addressJSON(claimed, store, reg))
+					return
+				}
+				w.WriteHeader(http.StatusConflict)
+				writeJSON(w, map[string]interface{}{
+					"error": "该邮箱已被占用，请提供令牌或换一个名称",
+				})
+				return
+			}
+			if !exists && d.Closed {
+				w.WriteHeader(http.StatusForbidden)
+				writeJSON(w, map[string]interface{}{
+					"error": fmt.Sprintf("域名 %s 已关闭注册", d.Name),
+				})
+				return
+			}
+			created := store.CreateAddress(addr)
+			writeJSON(w, addressJSON(created, store, reg))
 		default:
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	})
 
+	mux.HandleFunc("/api/domains", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		out := []map[string]interface{}{}
+		for _, d := range reg.All() {
+			registration := "open"
+			if d.Closed {
+				registration = "closed"
+			}
+			out = append(out, map[string]interface{}{
+				"name":         d.Name,
+				"default":      d.Name == reg.Default().Name,
+				"registration": registration,
+				"messageTTL":   int(cmp.Or(d.MessageTTL, store.TTL()).Seconds()),
+				"addressTTL":   int(cmp.Or(d.AddressTTL, store.AddressTTL()).Seconds()),
+			})
+		}
+		writeJSON(w, out)
+	})
+
+	mux.HandleFunc("/api/domains/", func(w http.ResponseWriter, r *http.Request) {
+		// GET /api/domains/{domain}/dns
+		name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/domains/"), "/")
+		if rest != "dns" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		d, ok := reg.Lookup(name)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, map[string]interface{}{"error": fmt.Sprintf("不支持的域名: %s", name)})
+			return
+		}
+		records := dnsRecords(d.Name, opts.SPF, opts.DKIM)
+		if r.URL.Query().Get("format") == "zone" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, zoneFile(records))
+			return
+		}
+		writeJSON(w, records)
+	})
+
+	mux.HandleFunc("/api/address/", func(w http.ResponseWriter, r *http.Request) {
+		// GET or DELETE /api/address/{local}, POST /api/address/{local}/extend
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/address/"), "/")
+		mailbox, ok := mailboxFromPath(reg, parts[0])
+		if !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "extend") {
+			http.NotFound(w, r)
+			return
+		}
+		extend := len(parts) == 2
+		methods := []string{http.MethodGet, http.MethodDelete}
+		if extend {
+			methods = []string{http.MethodPost}
+		}
+		if !allowMethods(w, r, methods...) {
+			return
+		}
+		if !authorized(store, opts, mailbox, r) {
+			writeUnauthorized(w)
+			return
+		}
+		if extend {
+			// ?ttl= asks for a shorter renewal; the address TTL of the
+			// domain is the ceiling.
+			_, dom := reg.Split(mailbox)
+			dc, _ := reg.Lookup(dom)
+			d := cmp.Or(dc.AddressTTL, store.AddressTTL())
+			if v := r.URL.Query().Get("ttl"); v != "" {
+				req, err := time.ParseDuration(v)
+				if err != nil || req <= 0 {
+					w.WriteHeader(http.StatusBadRequest)
+					writeJSON(w, map[string]interface{}{"error": "invalid ttl"})
+					return
+				}
+				d = min(req, d)
+			}
+			a, ok := store.ExtendAddress(mailbox, d)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, addressJSON(a, store, reg))
+			return
+		}
+		if r.Method == http.MethodGet {
+			a, ok := store.GetAddress(mailbox)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			writeJSON(w, addressJSON(a, store, reg))
+			return
+		}
+		if !store.DeleteAddress(mailbox) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
 	mux.HandleFunc("/api/messages/", func(w http.ResponseWriter, r *http.Request) {
-		// /api/messages/{local} or /api/messages/{local}/{id}
+		// {local} is a bare mailbox part on the default domain or a full
+		// mailbox@domain address.
+		// /api/messages/{local}, /api/messages/{local}/events,
+		// /api/messages/{local}/wait, /api/messages/{local}/{id},
+		// /api/messages/{local}/{id}/extract or
+		// /api/messages/{local}/{id}/attachments/{n}.
+		// DELETE on /api/messages/{local} clears the mailbox, on
+		// /api/messages/{local}/{id} it removes one message.
 		path := strings.TrimPrefix(r.URL.Path, "/api/messages/")
 		parts := strings.Split(path, "/")
-		if parts[0] == "" {
+		mailbox, ok := mailboxFromPath(reg, parts[0])
+		if !ok {
 			http.NotFound(w, r)
 			return
 		}
-		local := sanitizeLocal(parts[0])
+		// Only the mailbox and a single message can be deleted; everything
+		// else is read-only.
+		methods := []string{http.MethodGet}
+		if len(parts) == 1 || (len(parts) == 2 && parts[1] != "events" && parts[1] != "wait") {
+			methods = append(methods, http.MethodDelete)
+		}
+		if !allowMethods(w, r, methods...) {
+			return
+		}
+		if !authorized(store, opts, mailbox, r) {
+			writeUnauthorized(w)
+			return
+		}
 		if len(parts) == 1 {
-			msgs := store.List(local)
+			if r.Method == http.MethodDelete {
+				writeJSON(w, map[string]interface{}{"deleted": store.DeleteAll(mailbox)})
+				return
+			}
+			msgs := store.List(mailbox)
 			writeJSON(w, msgs)
 			return
 		}
+		switch parts[1] {
+		case "events":
+			serveEvents(w, r, store, mailbox)
+			return
+		case "wait":
+			serveWait(w, r, store, mailbox)
+			return
+		}
 		id := parts[1]
-		msg, ok := store.Get(local, id)
+		if len(parts) == 2 && r.Method == http.MethodDelete {
+			if !store.Delete(mailbox, id) {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		msg, ok := store.Get(mailbox, id)
 		if !ok {
 			http.NotFound(w, r)
 			return
 		}
+		if len(parts) == 4 && parts[2] == "attachments" {
+			serveAttachment(w, r, msg, parts[3])
+			return
+		}
+		if len(parts) == 3 && parts[2] == "extract" {
+			serveExtract(w, r, msg)
+			return
+		}
 		switch r.URL.Query().Get("format") {
 		case "raw":
 			w.Header().Set("Content-Type", "message/rfc822")
@@ -74,17 +274,23 @@ func NewMux(store storage.Store, domain string, smtpClient *smtpclient.Client) h
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-
-		// 解析请求体
-		var req struct {
-			From    string   `json:"from"`    // 发件人本地部分（如 "test"），将拼接域名
-			To      []string `json:"to"`      // 收件人列表（完整邮箱地址）
-			Subject string   `json:"subject"` // 邮件主题
-			Body    string   `json:"body"`    // 邮件正文
-			HTML    string   `json:"html"`    // HTML正文（可选）
+		if outbox == nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			writeJSON(w, map[string]interface{}{"error": "发送功能未启用"})
+			return
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		// 解析请求体（JSON 或 multipart 表单）
+		req, files, err := decodeSendRequest(w, r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			writeJSON(w, map[string]interface{}{
+				"error": fmt.Sprintf("邮件过大，附件合计不能超过 %d MB", maxSendBytes>>20),
+			})
+			return
+		}
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			writeJSON(w, map[string]interface{}{
 				"error": "无效的请求格式",
@@ -101,7 +307,7 @@ func NewMux(store storage.Store, domain string, smtpClient *smtpclient.Client) h
 			return
 		}
 
-		if len(req.To) == 0 {
+		if len(req.To)+len(req.Cc)+len(req.Bcc) == 0 {
 			w.WriteHeader(http.StatusBadRequest)
 			writeJSON(w, map[string]interface{}{
 				"error": "收件人不能为空",
@@ -126,48 +332,107 @@ func NewMux(store storage.Store, domain string, smtpClient *smtpclient.Client) h
 		}
 
 		// 验证发件人邮箱是否存在
-		fromLocal := sanitizeLocal(req.From)
-		if fromLocal == "" {
+		fromAddr, ok := mailboxFromPath(reg, req.From)
+		if !ok {
 			w.WriteHeader(http.StatusBadRequest)
 			writeJSON(w, map[string]interface{}{
-				"error": "发件人不能为空",
+				"error": "发件人不能为空，且必须属于本实例的域名",
 			})
 			return
 		}
 
-		// 如果地址不存在，自动创建
-		if !store.AddressExists(fromLocal) {
-			store.CreateAddress(fromLocal)
-			log.Printf("自动创建发件邮箱: %s@%s", fromLocal, domain)
+		// 如果地址不存在，自动创建（域名关闭注册时除外），令牌随响应返回；
+		// 已存在的邮箱只有持有令牌者可以使用，由来信创建、尚未认领的邮箱由本次请求认领
+		var token string
+		if !store.AddressExists(fromAddr) {
+			_, dom := reg.Split(fromAddr)
+			if d, _ := reg.Lookup(dom); d.Closed {
+				w.WriteHeader(http.StatusForbidden)
+				writeJSON(w, map[string]interface{}{
+					"error": fmt.Sprintf("域名 %s 已关闭注册", d.Name),
+				})
+				return
+			}
+			token = store.CreateAddress(fromAddr).Token
+			log.Printf("自动创建发件邮箱: %s", fromAddr)
+		} else if !authorized(store, opts, fromAddr, r) {
+			claimed, ok := store.ClaimAddress(fromAddr)
+			if !ok {
+				writeUnauthorized(w)
+				return
+			}
+			token = claimed.Token
 		}
 
-		// 构造完整的发件人地址
-		fromAddr := fmt.Sprintf("%s@%s", fromLocal, domain)
-
 		// 发送邮件
 		msg := smtpclient.Message{
-			From:    fromAddr,
-			To:      req.To,
-			Subject: req.Subject,
-			Body:    req.Body,
-			HTML:    req.HTML,
+			From:        fromAddr,
+			FromName:    req.FromName,
+			To:          req.To,
+			Cc:          req.Cc,
+			Bcc:         req.Bcc,
+			ReplyTo:     req.ReplyTo,
+			InReplyTo:   req.InReplyTo,
+			References:  req.References,
+			Headers:     req.Headers,
+			Subject:     req.Subject,
+			Body:        req.Body,
+			HTML:        req.HTML,
+			Attachments: files,
 		}
 
-		if err := smtpClient.Send(msg); err != nil {
-			log.Printf("发送邮件失败 (from=%s): %v", fromAddr, err)
-			w.WriteHeader(http.StatusInternalServerError)
+		item, err := outbox.Submit(msg)
+		if err != nil {
+			log.Printf("邮件入队失败 (from=%s): %v", fromAddr, err)
+			if errors.Is(err, outbound.ErrBadRecipient) || errors.Is(err, smtpclient.ErrBadHeader) {
+				w.WriteHeader(http.StatusBadRequest)
+			} else {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
 			writeJSON(w, map[string]interface{}{
 				"error": fmt.Sprintf("发送失败: %v", err),
 			})
 			return
 		}
 
-		log.Printf("邮件已发送: from=%s, to=%v, subject=%s", fromAddr, req.To, req.Subject)
-		writeJSON(w, map[string]interface{}{
+		log.Printf("邮件已入队: id=%s, from=%s, to=%v, subject=%s", item.ID, fromAddr, req.To, req.Subject)
+		resp := map[string]interface{}{
 			"success": true,
-			"message": "邮件已发送",
+			"message": "邮件已加入发送队列",
+			"id":      item.ID,
+			"status":  item.Status,
 			"from":    fromAddr,
-		})
+		}
+		if token != "" {
+			resp["token"] = token
+		}
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, resp)
+	})
+
+	mux.HandleFunc("/api/send/", func(w http.ResponseWriter, r *http.Request) {
+		// GET /api/send/{id}: delivery status of a queued message, readable
+		// with the sender mailbox's token.
+		id := strings.TrimPrefix(r.URL.Path, "/api/send/")
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if outbox == nil || id == "" || strings.Contains(id, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		item, err := outbox.Get(id)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, map[string]interface{}{"error": "发送任务不存在或已过期"})
+			return
+		}
+		if !authorized(store, opts, item.From, r) {
+			writeUnauthorized(w)
+			return
+		}
+		writeJSON(w, item)
 	})
 
 	// UI
@@ -182,29 +447,209 @@ func NewMux(store storage.Store, domain string, smtpClient *smtpclient.Client) h
 
 	// Message detail page
 	mux.HandleFunc("/view/", func(w http.ResponseWriter, r *http.Request) {
-		// /view/{local}/{id}
+		// /view/{mailbox}/{id}
 		path := strings.TrimPrefix(r.URL.Path, "/view/")
 		parts := strings.Split(path, "/")
-		if len(parts) < 2 {
+		mailbox, ok := mailboxFromPath(reg, parts[0])
+		if len(parts) < 2 || !ok {
 			http.NotFound(w, r)
 			return
 		}
-		local := sanitizeLocal(parts[0])
 		id := parts[1]
+		if !authorized(store, opts, mailbox, r) {
+			writeUnauthorized(w)
+			return
+		}
 
-		msg, ok := store.Get(local, id)
+		msg, ok := store.Get(mailbox, id)
 		if !ok {
 			http.NotFound(w, r)
 			return
 		}
 
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		_, _ = w.Write([]byte(renderMessageDetailPage(msg, local, domain)))
+		_, _ = w.Write([]byte(renderMessageDetailPage(msg, mailbox, requestToken(r))))
 	})
 
 	return mux
 }
 
+// sseKeepAlive is how often an idle event stream gets a comment line, so
+// proxies do not cut the connection.
+const sseKeepAlive = 15 * time.Second
+
+// serveEvents streams new messages of mailbox as Server-Sent Events. Each event
+// carries the message JSON and uses the message ID as event ID; a client that
+// reconnects with Last-Event-ID first receives everything saved after it.
+func serveEvents(w http.ResponseWriter, r *http.Request, store storage.Store, mailbox string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before replaying so nothing saved in between is lost.
+	ch, cancel := store.Subscribe(mailbox)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprint(w, "retry: 3000\n\n")
+
+	sent := make(map[string]bool)
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("lastEventId")
+	}
+	if lastID != "" {
+		msgs := store.List(mailbox)
+		prev, known := store.Get(mailbox, lastID)
+		// List is newest first; replay oldest first. An unknown ID (already
+		// purged) replays the whole mailbox.
+		for i := len(msgs) - 1; i >= 0; i-- {
+			if known && !msgs[i].CreatedAt.After(prev.CreatedAt) {
+				continue
+			}
+			if err := writeEvent(w, msgs[i]); err != nil {
+				return
+			}
+			sent[msgs[i].ID] = true
+		}
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case msg := <-ch:
+			if sent[msg.ID] {
+				continue
+			}
+			if err := writeEvent(w, msg); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-ticker.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+func writeEvent(w io.Writer, msg storage.Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: message\ndata: %s\n\n", msg.ID, data)
+	return err
+}
+
+// serveExtract runs code and link extraction on demand, optionally with a
+// caller supplied code pattern (?pattern=).
+func serveExtract(w http.ResponseWriter, r *http.Request, msg storage.Message) {
+	var custom *regexp.Regexp
+	if p := r.URL.Query().Get("pattern"); p != "" {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]interface{}{
+				"error": fmt.Sprintf("invalid pattern: %v", err),
+			})
+			return
+		}
+		custom = re
+	}
+	root, err := mimeparse.Parse(msg.Raw)
+	if err != nil {
+		writeJSON(w, extract.FromBodies(string(msg.Raw), "", custom))
+		return
+	}
+	writeJSON(w, extract.FromMessage(root, custom))
+}
+
+// inlineAttachmentTypes may be shown in the browser with ?inline=1.
+var inlineAttachmentTypes = map[string]bool{
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+	"application/pdf": true,
+}
+
+// serveAttachment streams the n-th attachment of msg, re-extracted from the
+// raw MIME.
+func serveAttachment(w http.ResponseWriter, r *http.Request, msg storage.Message, n string) {
+	idx, err := strconv.Atoi(n)
+	if err != nil || idx < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	root, err := mimeparse.Parse(msg.Raw)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	atts := root.Attachments()
+	if idx >= len(atts) {
+		http.NotFound(w, r)
+		return
+	}
+	part := atts[idx]
+	name := part.Filename()
+	if name == "" {
+		name = fmt.Sprintf("attachment-%d", idx)
+	}
+	// Anything that could run script (HTML, SVG, ...) is only ever offered
+	// as a download; the sandbox CSP covers browsers that render it anyway.
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") == "1" && inlineAttachmentTypes[part.MediaType] {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", part.MediaType)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("Content-Length", strconv.Itoa(len(part.Body)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = w.Write(part.Body)
+}
+
+// addressJSON is the address record as returned by the address endpoints.
+func addressJSON(a storage.Address, store storage.Store, reg *domains.Registry) map[string]interface{} {
+	usage, _ := store.Usage(a.Addr)
+	local, dom := reg.Split(a.Addr)
+	d, _ := reg.Lookup(dom)
+	return map[string]interface{}{
+		"usage":      usage,
+		"address":    a.Addr,
+		"local":      local,
+		"domain":     dom,
+		"token":      a.Token,
+		"createdAt":  a.CreatedAt,
+		"expiresAt":  a.ExpiresAt,
+		"expiresIn":  int(max(time.Until(a.ExpiresAt), 0).Seconds()),
+		"messageTTL": int(cmp.Or(d.MessageTTL, store.TTL()).Seconds()),
+	}
+}
+
+// mailboxFromPath resolves the mailbox segment of a URL, a bare local part
+// on the default domain or a full address, to its store key. ok is false for
+// an empty local part or a domain this instance does not serve.
+func mailboxFromPath(reg *domains.Registry, seg string) (string, bool) {
+	local, dom := reg.Split(seg)
+	local = sanitizeLocal(local)
+	if _, ok := reg.Lookup(dom); !ok || local == "" {
+		return "", false
+	}
+	return local + "@" + dom, true
+}
+
 func writeJSON(w http.ResponseWriter, v any) {
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(v); err != nil {
@@ -212,6 +657,17 @@ func writeJSON(w http.ResponseWriter, v any) {
 	}
 }
 
+// allowMethods reports whether r uses one of methods. Otherwise it answers
+// 405 with an Allow header listing them.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if slices.Contains(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusMethodNotAllowed)
+	return false
+}
+
 func sanitizeLocal(s string) string {
 	s = strings.ToLower(strings.TrimSpace(s))
 	s = strings.Trim(s, "@ ")
@@ -234,9 +690,9 @@ func sanitizeLocal(s string) string {
 	return b.String()
 }
 
-func renderMessageDetailPage(msg storage.Message, local, domain string) string {
+func renderMessageDetailPage(msg storage.Message, mailbox, token string) string {
 	// Parse email content from raw bytes
-	htmlContent, textContent, _ := parseEmailContent(msg.Raw)
+	htmlContent, textContent := parseEmailContent(msg.Raw)
 
 	// Choose which content to display
 	bodyHTML := ""
@@ -252,175 +708,152 @@ func renderMessageDetailPage(msg storage.Message, local, domain string) string {
 
 	timeStr := msg.CreatedAt.Format("2006-01-02 15:04:05")
 
+	// Links on the page carry the mailbox token along.
+	tokenParam := ""
+	if token != "" {
+		tokenParam = "token=" + url.QueryEscape(token)
+	}
+	mailboxQuery := url.QueryEscape(mailbox)
+	rawQuery := ""
+	attachmentQuery := ""
+	if tokenParam != "" {
+		mailboxQuery += "&" + tokenParam
+		rawQuery = "&" + tokenParam
+		attachmentQuery = "?" + tokenParam
+	}
+
+	attachmentsHTML := ""
+	if len(msg.Attachments) > 0 {
+		var sb strings.Builder
+		sb.WriteString(`<div class="meta-row"><span class="meta-label">FILES:</span> <span class="attachments">`)
+		for i, a := range msg.Attachments {
+			name := a.Filename
+			if name == "" {
+				name = fmt.Sprintf("attachment-%d", i)
+			}
+			sb.WriteString(fmt.Sprintf(`<a class="attachment" href="/api/messages/%s/%s/attachments/%d%s">%s <small>(%s)</small></a>`,
+				url.PathEscape(mailbox), msg.ID, i, attachmentQuery, escapeHTML(name), formatSize(a.Size)))
+		}
+		sb.WriteString(`</span></div>`)
+		attachmentsHTML = sb.String()
+	}
+
 	return fmt.Sprintf(messageDetailTemplate,
 		escapeHTML(msg.Subject),
-		local,
+		mailboxQuery,
 		escapeHTML(msg.Subject),
 		escapeHTML(msg.From),
 		timeStr,
+		attachmentsHTML+envelopeHTML(msg)+authHTML(msg.Auth),
 		bodyHTML,
-		local,
+		url.PathEscape(mailbox),
 		msg.ID,
-		local,
+		rawQuery,
+		mailboxQuery,
 	)
 }
 
-func parseEmailContent(raw []byte) (htmlContent, textContent string, headers map[string]string) {
-	headers = make(map[string]string)
-
-	if len(raw) == 0 {
-		return "", "", headers
+// envelopeHTML renders the SMTP envelope rows of the detail page and flags a
+// MAIL FROM that differs from the header From.
+func envelopeHTML(msg storage.Message) string {
+	env := msg.Envelope
+	if env == nil {
+		return ""
 	}
-
-	// Parse email using net/mail
-	m, err := stdmail.ReadMessage(bytes.NewReader(raw))
-	if err != nil {
-		textContent = string(raw)
-		return "", textContent, headers
+	var sb strings.Builder
+	mailFrom := "&lt;&gt;"
+	if env.MailFrom != "" {
+		mailFrom = escapeHTML(env.MailFrom)
 	}
-
-	// Extract and decode headers using mime.WordDecoder
-	dec := new(mime.WordDecoder)
-	for k := range m.Header {
-		rawValue := m.Header.Get(k)
-		// Decode MIME encoded-words (=?charset?encoding?text?=)
-		if decoded, err := dec.DecodeHeader(rawValue); err == nil {
-			headers[k] = decoded
-		} else {
-			headers[k] = rawValue
-		}
+	mismatch := ""
+	if hdr, err := stdmail.ParseAddress(msg.From); err == nil && !strings.EqualFold(hdr.Address, env.MailFrom) {
+		mismatch = ` <span class="mismatch">≠ FROM</span>`
 	}
-
-	// Read body
-	body, err := io.ReadAll(m.Body)
-	if err != nil {
-		return "", "", headers
+	sb.WriteString(fmt.Sprintf(`<div class="meta-row"><span class="meta-label">MAIL FROM:</span> <span>%s%s</span></div>`, mailFrom, mismatch))
+	sb.WriteString(fmt.Sprintf(`<div class="meta-row"><span class="meta-label">RCPT TO:</span> <span>%s</span></div>`, escapeHTML(strings.Join(env.RcptTo, ", "))))
+	client := escapeHTML(env.Helo) + " [" + escapeHTML(env.RemoteIP) + "]"
+	if msg.TLS != nil {
+		client += " · " + escapeHTML(msg.TLS.Version+" "+msg.TLS.Cipher)
 	}
+	sb.WriteString(fmt.Sprintf(`<div class="meta-row"><span class="meta-label">CLIENT:</span> <span>%s</span></div>`, client))
+	return sb.String()
+}
 
-	// Check Content-Transfer-Encoding and decode body
-	contentTransferEncoding := strings.ToLower(m.Header.Get("Content-Transfer-Encoding"))
-	decodedBody := body
-
-	switch contentTransferEncoding {
-	case "base64":
-		if decoded, err := base64.StdEncoding.DecodeString(string(body)); err == nil {
-			decodedBody = decoded
+// authHTML renders the SPF, DKIM and DMARC results as badges; the reason
+// shows on hover.
+func authHTML(res *mailauth.Results) string {
+	if res == nil {
+		return ""
+	}
+	badge := func(method string, r mailauth.Result) string {
+		label := method + "=" + r.Result
+		if r.Domain != "" {
+			label += " (" + r.Domain + ")"
+		}
+		if r.Policy != "" {
+			label += " p=" + r.Policy
 		}
-	case "quoted-printable":
-		// Quoted-printable decoding
-		decodedBody = decodeQuotedPrintable(body)
+		return fmt.Sprintf(`<span class="auth auth-%s" title="%s">%s</span>`, escapeHTMLAttr(r.Result), escapeHTMLAttr(r.Reason), escapeHTML(label))
 	}
-
-	bodyStr := string(decodedBody)
-
-	// Check if it's multipart
-	contentType := m.Header.Get("Content-Type")
-	if strings.Contains(contentType, "multipart") {
-		// Simple multipart parsing with encoding support
-		htmlContent, textContent = parseMultipart(bodyStr, contentType)
-	} else if strings.Contains(contentType, "text/html") {
-		htmlContent = bodyStr
-	} else {
-		textContent = bodyStr
+	var sb strings.Builder
+	sb.WriteString(`<div class="meta-row"><span class="meta-label">AUTH:</span> <span class="attachments">`)
+	sb.WriteString(badge("spf", res.SPF))
+	if len(res.DKIM) == 0 {
+		sb.WriteString(badge("dkim", mailauth.Result{Result: mailauth.None}))
 	}
-
-	return htmlContent, textContent, headers
+	for _, d := range res.DKIM {
+		sb.WriteString(badge("dkim", d))
+	}
+	sb.WriteString(badge("dmarc", res.DMARC))
+	sb.WriteString(`</span></div>`)
+	return sb.String()
 }
 
-func parseMultipart(body, contentType string) (html, text string) {
-	// Extract boundary
-	boundary := ""
-	if idx := strings.Index(contentType, "boundary="); idx >= 0 {
-		boundary = contentType[idx+9:]
-		boundary = strings.Trim(boundary, `"`)
-		if idx2 := strings.IndexAny(boundary, "; \t\r\n"); idx2 >= 0 {
-			boundary = boundary[:idx2]
-		}
+func formatSize(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", n)
 	}
+}
 
-	if boundary == "" {
-		return "", body
+func parseEmailContent(raw []byte) (htmlContent, textContent string) {
+	if len(raw) == 0 {
+		return "", ""
 	}
 
-	parts := strings.Split(body, "--"+boundary)
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "" || part == "--" {
-			continue
-		}
+	root, err := mimeparse.Parse(raw)
+	if err != nil {
+		return "", string(raw)
+	}
+	return inlineContentIDs(root, root.HTML()), root.Text()
+}
 
-		// Split headers and body
-		splitIdx := strings.Index(part, "\r\n\r\n")
-		if splitIdx < 0 {
-			splitIdx = strings.Index(part, "\n\n")
-			if splitIdx < 0 {
-				continue
-			}
-			splitIdx += 2
-		} else {
-			splitIdx += 4
-		}
+var cidRef = regexp.MustCompile(`(?i)cid:([^"'\s>)]+)`)
 
-		headers := part[:splitIdx]
-		content := part[splitIdx:]
+// inlineImageType matches the media types inlineContentIDs puts into data:
+// URLs. Parts with malformed parameters keep their raw type, so it is
+// checked character by character.
+var inlineImageType = regexp.MustCompile(`^image/[a-z0-9][a-z0-9.+-]*$`)
 
-		// Decode content based on Content-Transfer-Encoding
-		if strings.Contains(headers, "base64") {
-			content = strings.ReplaceAll(content, "\r\n", "")
-			content = strings.ReplaceAll(content, "\n", "")
-			if decoded, err := base64.StdEncoding.DecodeString(content); err == nil {
-				content = string(decoded)
-			}
-		} else if strings.Contains(headers, "quoted-printable") {
-			content = string(decodeQuotedPrintable([]byte(content)))
-		}
-
-		if strings.Contains(headers, "text/html") {
-			html = content
-		} else if strings.Contains(headers, "text/plain") && text == "" {
-			text = content
-		}
+// inlineContentIDs rewrites cid: references of multipart/related images to
+// data: URLs so they show up inside the sandboxed iframe. The media type is
+// chosen by the sender, so only raster images are inlined; any other cid:
+// reference is dropped.
+func inlineContentIDs(root *mimeparse.Part, htmlContent string) string {
+	if htmlContent == "" {
+		return htmlContent
 	}
-
-	return html, text
-}
-
-// decodeQuotedPrintable decodes quoted-printable encoded text
-func decodeQuotedPrintable(data []byte) []byte {
-	var result bytes.Buffer
-	i := 0
-	for i < len(data) {
-		if data[i] == '=' {
-			if i+2 < len(data) {
-				// Soft line break
-				if data[i+1] == '\r' && data[i+2] == '\n' {
-					i += 3
-					continue
-				}
-				if data[i+1] == '\n' {
-					i += 2
-					continue
-				}
-				// Hex encoding
-				if i+2 < len(data) {
-					hex := string(data[i+1 : i+3])
-					var b byte
-					if _, err := fmt.Sscanf(hex, "%02X", &b); err == nil {
-						result.WriteByte(b)
-						i += 3
-						continue
-					}
-				}
-			}
-			// Invalid encoding, keep the =
-			result.WriteByte(data[i])
-			i++
-		} else {
-			result.WriteByte(data[i])
-			i++
+	return cidRef.ReplaceAllStringFunc(htmlContent, func(ref string) string {
+		part := root.FindContentID(ref[len("cid:"):])
+		if part == nil || !inlineImageType.MatchString(part.MediaType) || part.MediaType == "image/svg+xml" {
+			return ""
 		}
-	}
-	return result.Bytes()
+		return "data:" + part.MediaType + ";base64," + base64.StdEncoding.EncodeToString(part.Body)
+	})
 }
 
 func escapeHTML(s string) string {
@@ -680,13 +1113,21 @@ const indexHTML = `<!doctype html>
       border-bottom: 1px solid var(--hud-border);
       background: rgba(57, 255, 20, 0.05);
       flex-shrink: 0;
+      display: flex; align-items: center; justify-content: space-between; gap: 1rem;
+    }
+    .mailbox-actions { display: none; gap: 0.5rem; }
+    .btn-danger { font-size: 0.65rem; padding: 0.4rem 0.8rem; border-color: var(--warning); color: var(--warning); }
+    .message-delete {
+      background: none; border: none; color: var(--text-muted); cursor: pointer;
+      font-size: 0.8rem; margin-left: 0.6rem; padding: 0 0.2rem;
     }
+    .message-delete:hover { color: var(--warning); }
     
     /* 输入框：终端风格 */
     .create-section { display: flex; gap: 1rem; margin-bottom: 1.2rem; }
     .input-wrapper { flex: 1; position: relative; }
     
-    input, textarea {
+    input, textarea, select {
       width: 100%; padding: 0.8rem 1rem; font-size: 1rem;
       background: rgba(0, 20, 0, 0.6); 
       border: 1px solid var(--text-muted);
@@ -695,6 +1136,7 @@ const indexHTML = `<!doctype html>
       transition: all 0.3s ease;
       text-transform: lowercase;
     }
+    #domain { width: auto; display: none; text-transform: none; }
     input:focus, textarea:focus {
       outline: none; border-color: var(--alien-green);
       box-shadow: 0 0 15px var(--alien-dim);
@@ -830,12 +1272,25 @@ const indexHTML = `<!doctype html>
     }
   </style>
   <script>
-    let currentLocal = '';
+    let currentMailbox = '';
     let currentDomain = '';
+    let currentToken = '';
     let pollInterval = null;
-    let messageTTL = 30;
+    let eventSource = null;
+    let addressExpiresAt = null;
     let lastMessageIds = [];
     
+    // 邮箱令牌保存在 localStorage，刷新或从详情页返回时无需重新输入
+    function savedToken(local) {
+      try { return localStorage.getItem('mailbox-token:' + local) || ''; } catch (e) { return ''; }
+    }
+    function rememberToken(local, token) {
+      try { if (token) localStorage.setItem('mailbox-token:' + local, token); } catch (e) {}
+    }
+    function tokenHeaders(token) {
+      return token ? {'X-Mailbox-Token': token} : {};
+    }
+
     async function createAddr() {
       const input = document.getElementById('local');
       const desired = input.value.trim();
@@ -847,15 +1302,21 @@ const indexHTML = `<!doctype html>
       btn.innerHTML = '<span class="loading"></span>';
       
       try {
-        const r = await fetch('/api/address?local=' + encodeURIComponent(desired), {method: 'POST'});
+        const domain = document.getElementById('domain').value;
+        const key = desired.includes('@') ? desired.toLowerCase() : desired.toLowerCase() + '@' + domain;
+        const r = await fetch('/api/address?local=' + encodeURIComponent(desired) + '&domain=' + encodeURIComponent(domain), {method: 'POST', headers: tokenHeaders(savedToken(key))});
         const j = await r.json();
-        currentLocal = j.local;
+        if (r.status === 409) { showToast('ALIAS TAKEN', 'error'); return; }
+        if (r.status === 403) { showToast('DOMAIN CLOSED', 'error'); return; }
+        if (!r.ok) throw new Error(j.error);
+        currentMailbox = j.address;
+        currentToken = j.token || '';
+        rememberToken(j.address, currentToken);
         currentDomain = j.address.split('@')[1];
-        messageTTL = j.ttl || 30;
         document.getElementById('addr').textContent = j.address;
         document.getElementById('copy-section').style.display = 'block';
-        document.getElementById('ttl-info').style.display = 'block';
-        document.getElementById('ttl-minutes').textContent = messageTTL;
+        showAddressExpiry(j.expiresAt);
+        document.getElementById('mailbox-actions').style.display = 'flex';
         const sendFromInput = document.getElementById('send-from');
         if (sendFromInput) {
           sendFromInput.value = j.address;
@@ -875,10 +1336,35 @@ const indexHTML = `<!doctype html>
       finally { btn.disabled = false; btn.textContent = originalBtnText; }
     }
     
+    // 邮箱本身有独立的有效期，到期后连同邮件一起销毁
+    function showAddressExpiry(expiresAt) {
+      addressExpiresAt = new Date(expiresAt);
+      document.getElementById('ttl-info').style.display = 'block';
+      updateAddressTimer();
+    }
+
+    function updateAddressTimer() {
+      if (!addressExpiresAt) return;
+      const left = Math.max(0, Math.floor((addressExpiresAt - new Date()) / 60000));
+      document.getElementById('ttl-minutes').textContent = left;
+    }
+
+    async function extendAddress() {
+      if (!currentMailbox) return;
+      try {
+        const r = await fetch('/api/address/' + encodeURIComponent(currentMailbox) + '/extend', {method: 'POST', headers: tokenHeaders(currentToken)});
+        const j = await r.json();
+        if (!r.ok) throw new Error(j.error);
+        showAddressExpiry(j.expiresAt);
+        showToast('>>> LIFETIME EXTENDED');
+      } catch (e) { showToast('EXTEND FAILED', 'error'); }
+    }
+
     async function loadMsgs() {
-      if (!currentLocal) return;
+      if (!currentMailbox) return;
+      updateAddressTimer();
       try {
-        const r = await fetch('/api/messages/' + currentLocal);
+        const r = await fetch('/api/messages/' + encodeURIComponent(currentMailbox), {headers: tokenHeaders(currentToken)});
         const msgs = await r.json() || [];
         document.getElementById('inbox-badge').textContent = msgs.length;
         if (msgs.length === 0) {
@@ -901,13 +1387,14 @@ const indexHTML = `<!doctype html>
         const div = document.createElement('div');
         div.className = 'message-item';
         div.setAttribute('data-msg-id', m.id);
-        div.onclick = function() { window.location.href = '/view/' + currentLocal + '/' + m.id; };
+        div.onclick = function() { window.location.href = '/view/' + encodeURIComponent(currentMailbox) + '/' + m.id + '?token=' + encodeURIComponent(currentToken); };
         const now = new Date();
         const minutesLeft = Math.max(0, Math.floor((new Date(m.expiresAt) - now) / 60000));
         div.innerHTML = 
           '<div class="message-header">' +
             '<div class="message-from">' + escapeHtml(m.from || 'UNKNOWN ENTITY') + '</div>' +
-            '<div class="message-time">' + new Date(m.createdAt).toLocaleTimeString() + '</div>' +
+            '<div class="message-time">' + new Date(m.createdAt).toLocaleTimeString() +
+              '<button class="message-delete" title="DELETE" onclick="deleteMsg(event, \'' + m.id + '\')">✕</button></div>' +
           '</div>' +
           '<div class="message-subject">' + escapeHtml(m.subject || 'ENCRYPTED') + '</div>' +
           '<div class="message-snippet">' + escapeHtml(m.snippet || '') + '</div>' + 
@@ -927,6 +1414,45 @@ const indexHTML = `<!doctype html>
         });
     }
     
+    async function deleteMsg(ev, id) {
+      ev.stopPropagation();
+      try {
+        const r = await fetch('/api/messages/' + encodeURIComponent(currentMailbox) + '/' + id, {method: 'DELETE', headers: tokenHeaders(currentToken)});
+        if (!r.ok && r.status !== 404) throw new Error(r.status);
+        loadMsgs();
+      } catch (e) { showToast('DELETE FAILED', 'error'); }
+    }
+
+    async function clearInbox() {
+      if (!currentMailbox || !confirm('Delete all messages in this mailbox?')) return;
+      try {
+        const r = await fetch('/api/messages/' + encodeURIComponent(currentMailbox), {method: 'DELETE', headers: tokenHeaders(currentToken)});
+        if (!r.ok) throw new Error(r.status);
+        loadMsgs();
+        showToast('>>> INBOX PURGED');
+      } catch (e) { showToast('PURGE FAILED', 'error'); }
+    }
+
+    async function deleteAddress() {
+      if (!currentMailbox || !confirm('Delete this mailbox and all of its messages?')) return;
+      try {
+        const r = await fetch('/api/address/' + encodeURIComponent(currentMailbox), {method: 'DELETE', headers: tokenHeaders(currentToken)});
+        if (!r.ok && r.status !== 404) throw new Error(r.status);
+        localStorage.removeItem('mailbox-token:' + currentMailbox);
+        if (pollInterval) { clearInterval(pollInterval); pollInterval = null; }
+        if (eventSource) { eventSource.close(); eventSource = null; }
+        currentMailbox = ''; currentToken = ''; lastMessageIds = []; addressExpiresAt = null;
+        document.getElementById('addr').textContent = 'WAITING FOR INPUT...';
+        document.getElementById('copy-section').style.display = 'none';
+        document.getElementById('ttl-info').style.display = 'none';
+        document.getElementById('mailbox-actions').style.display = 'none';
+        document.getElementById('send-from').value = '';
+        document.getElementById('inbox-badge').textContent = '0';
+        document.getElementById('messages-container').innerHTML = '<div class="empty-state"><div class="empty-state-icon">👾</div><h3>SYSTEM READY</h3><p>Scanning for incoming signals...</p></div>';
+        showToast('>>> MAILBOX DESTROYED');
+      } catch (e) { showToast('DESTROY FAILED', 'error'); }
+    }
+
     function copyAddress() {
       const addr = document.getElementById('addr').textContent;
       navigator.clipboard.writeText(addr).then(() => showToast('>>> COPIED TO CLIPBOARD')).catch(() => showToast('COPY FAILED', 'error'));
@@ -951,12 +1477,12 @@ const indexHTML = `<!doctype html>
         body.classList.add('scroll-mode');
         container.classList.add('scroll-mode');
         contentCard.classList.add('auto-height');
-        if (!currentLocal) showToast('! ERROR: NO UPLINK DETECTED !', 'error');
+        if (!currentMailbox) showToast('! ERROR: NO UPLINK DETECTED !', 'error');
       }
     }
     
     async function sendEmail() {
-      if (!currentLocal) { showToast('Initialize Uplink First', 'error'); return; }
+      if (!currentMailbox) { showToast('Initialize Uplink First', 'error'); return; }
       const to = document.getElementById('send-to').value;
       const subject = document.getElementById('send-subject').value;
       const body = document.getElementById('send-body').value;
@@ -967,22 +1493,46 @@ const indexHTML = `<!doctype html>
       try {
         const res = await fetch('/api/send', {
           method: 'POST',
-          headers: {'Content-Type': 'application/json'},
-          body: JSON.stringify({ from: currentLocal, to: to.split(','), subject, body }),
+          headers: Object.assign({'Content-Type': 'application/json'}, tokenHeaders(currentToken)),
+          body: JSON.stringify({ from: currentMailbox, to: to.split(','), subject, body }),
         });
         const json = await res.json();
         if (res.ok && json.success) {
-          showToast('>>> SENT SUCCESSFULLY');
+          showToast('>>> QUEUED FOR DELIVERY');
           document.getElementById('send-body').value = '';
           document.getElementById('send-subject').value = '';
+          watchDelivery(json.id, currentToken);
         } else { throw new Error(json.error); }
       } catch (e) { showToast('TRANSMISSION FAILED', 'error'); } 
       finally { btn.textContent = originalText; }
     }
+
+    // 轮询发送队列，投递完成或退信时提示；重试中的邮件最多跟踪 10 分钟
+    function watchDelivery(id, token) {
+      let tries = 0;
+      const timer = setInterval(async () => {
+        if (++tries > 200) { clearInterval(timer); return; }
+        try {
+          const r = await fetch('/api/send/' + encodeURIComponent(id), { headers: tokenHeaders(token) });
+          if (!r.ok) { clearInterval(timer); return; }
+          const item = await r.json();
+          if (item.status === 'sent') { clearInterval(timer); showToast('>>> DELIVERED'); }
+          else if (item.status === 'bounced' || item.status === 'partial') { clearInterval(timer); showToast('DELIVERY FAILED: ' + item.status.toUpperCase(), 'error'); }
+        } catch (e) {}
+      }, 3000);
+    }
     
+    // 新邮件通过 SSE 推送；低频轮询只用于刷新倒计时，并在浏览器不支持 EventSource 时兜底
     function startPolling() {
       if (pollInterval) clearInterval(pollInterval);
-      pollInterval = setInterval(loadMsgs, 4000);
+      if (eventSource) { eventSource.close(); eventSource = null; }
+      if (window.EventSource) {
+        eventSource = new EventSource('/api/messages/' + encodeURIComponent(currentMailbox) + '/events?token=' + encodeURIComponent(currentToken));
+        eventSource.addEventListener('message', () => loadMsgs());
+        pollInterval = setInterval(loadMsgs, 30000);
+      } else {
+        pollInterval = setInterval(loadMsgs, 4000);
+      }
     }
     
     function showToast(msg, type='success') {
@@ -996,21 +1546,43 @@ const indexHTML = `<!doctype html>
       const div = document.createElement('div'); div.innerText = text; return div.innerHTML;
     }
 
+    // 多域名时显示域名选择框
+    async function loadDomains() {
+      try {
+        const r = await fetch('/api/domains');
+        const list = await r.json();
+        const sel = document.getElementById('domain');
+        sel.innerHTML = '';
+        for (const d of list) {
+          const opt = document.createElement('option');
+          opt.value = d.name;
+          opt.textContent = '@' + d.name + (d.registration === 'closed' ? ' (closed)' : '');
+          if (d.default) opt.selected = true;
+          sel.appendChild(opt);
+        }
+        sel.style.display = list.length > 1 ? 'block' : 'none';
+      } catch (e) { console.error(e); }
+    }
+
     document.addEventListener('DOMContentLoaded', () => {
+        loadDomains();
         const params = new URLSearchParams(window.location.search);
         if (params.get('mailbox')) {
             const mailbox = params.get('mailbox');
-            currentLocal = mailbox;
+            currentMailbox = mailbox;
+            currentToken = params.get('token') || savedToken(mailbox);
             document.getElementById('local').value = mailbox;
             // Try to determine domain - call API to get full address
-            fetch('/api/address?local=' + encodeURIComponent(mailbox), {method: 'POST'})
-                .then(r => r.json())
+            fetch('/api/address?local=' + encodeURIComponent(mailbox), {method: 'POST', headers: tokenHeaders(currentToken)})
+                .then(r => r.json().then(j => { if (!r.ok) throw new Error(j.error); return j; }))
                 .then(j => {
+                    currentMailbox = j.address;
+                    currentToken = j.token || '';
+                    rememberToken(j.address, currentToken);
                     currentDomain = j.address.split('@')[1];
                     document.getElementById('addr').textContent = j.address;
                     document.getElementById('copy-section').style.display = 'block';
-                    document.getElementById('ttl-info').style.display = 'block';
-                    document.getElementById('ttl-minutes').textContent = j.ttl || 30;
+                    showAddressExpiry(j.expiresAt);
                     document.getElementById('send-from').value = j.address;
                     loadMsgs();
                     startPolling();
@@ -1035,6 +1607,7 @@ const indexHTML = `<!doctype html>
         <div class="input-wrapper">
           <input id="local" type="text" placeholder="ENTER ALIAS..." autocomplete="off" onkeyup="if(event.key === 'Enter') createAddr()" />
         </div>
+        <select id="domain"></select>
         <button class="btn" onclick="createAddr()">INITIALIZE</button>
       </div>
       
@@ -1047,7 +1620,8 @@ const indexHTML = `<!doctype html>
       </div>
       
       <div id="ttl-info">
-         ⚠️ WARNING: DATA PURGE IN <strong id="ttl-minutes">30</strong> MIN
+         ⚠️ WARNING: MAILBOX SELF-DESTRUCTS IN <strong id="ttl-minutes">0</strong> MIN
+         <button class="btn btn-danger" style="margin-left:0.8rem;" onclick="extendAddress()">EXTEND</button>
       </div>
     </div>
 
@@ -1061,6 +1635,10 @@ const indexHTML = `<!doctype html>
             📤 TRANSMIT
           </button>
         </div>
+        <div id="mailbox-actions" class="mailbox-actions">
+          <button class="btn btn-danger" onclick="clearInbox()">PURGE INBOX</button>
+          <button class="btn btn-danger" onclick="deleteAddress()">DESTROY</button>
+        </div>
       </div>
       
       <div id="inbox-tab" class="tab-content active">
@@ -1202,6 +1780,18 @@ const messageDetailTemplate = `<!doctype html>
       color: #80a080; margin-bottom: 0.3rem; display: flex; gap: 1rem;
     }
     .meta-label { color: var(--alien-green); min-width: 60px; }
+    .attachments { display: flex; flex-wrap: wrap; gap: 0.5rem; }
+    .attachment {
+      color: var(--alien-green); text-decoration: none;
+      border: 1px dashed var(--border-color); padding: 0.1rem 0.5rem;
+    }
+    .attachment:hover { background: rgba(57, 255, 20, 0.1); }
+    .attachment small { color: #80a080; }
+    .auth { border: 1px solid #80a080; color: #80a080; padding: 0 0.4rem; cursor: help; }
+    .auth-pass { border-color: var(--alien-green); color: var(--alien-green); }
+    .auth-fail, .auth-permerror { border-color: #ff4040; color: #ff4040; }
+    .auth-softfail, .auth-temperror { border-color: #ffb000; color: #ffb000; }
+    .mismatch { color: #ffb000; border: 1px solid #ffb000; padding: 0 0.3rem; margin-left: 0.3rem; }
     
     .email-content-wrapper {
       flex: 1;
@@ -1260,6 +1850,7 @@ const messageDetailTemplate = `<!doctype html>
         <div class="subject">%s</div>
         <div class="meta-row"><span class="meta-label">FROM:</span> <span>%s</span></div>
         <div class="meta-row"><span class="meta-label">TIME:</span> <span>%s</span></div>
+        %s
       </div>
       
       <div class="email-content-wrapper">
@@ -1267,7 +1858,7 @@ const messageDetailTemplate = `<!doctype html>
       </div>
       
       <div class="action-bar">
-        <a href="/api/messages/%s/%s?format=raw" download="message.eml" class="btn btn-outline">DOWNLOAD RAW</a>
+        <a href="/api/messages/%s/%s?format=raw%s" download="message.eml" class="btn btn-outline">DOWNLOAD RAW</a>
         <a href="/?mailbox=%s" class="btn">CLOSE VIEWER</a>
       </div>
     </div>
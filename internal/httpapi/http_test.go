@@ -0,0 +1,495 @@
+package httpapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"temp_mail/internal/dkimkeys"
+	"temp_mail/internal/domains"
+	"temp_mail/internal/mimeparse"
+	"temp_mail/internal/outbound"
+	"temp_mail/internal/smtpclient"
+	"temp_mail/internal/storage"
+)
+
+func testDomains(t *testing.T) *domains.Registry {
+	t.Helper()
+	reg, err := domains.New(domains.Domain{Name: "tmp.local"}, domains.Domain{Name: "closed.test", Closed: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestWait_MatchesLiveAndEarlierMessages(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	mux := NewMux(store, testDomains(t), nil, Options{OpenMode: true})
+
+	store.CreateAddress("qa@tmp.local")
+	raw := []byte("From: noreply@shop.test\r\nSubject: Verify\r\n\r\nYour code is 482913\r\n")
+	early, _ := store.Save("qa@tmp.local", storage.Message{From: "noreply@shop.test", Subject: "Verify", Raw: raw})
+
+	// since picks up the message that arrived before the call.
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/messages/qa/wait?since=1m&contains=482913", nil))
+	var got storage.Message
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got.ID != early.ID {
+		t.Fatalf("since: code=%d id=%q err=%v", rec.Code, got.ID, err)
+	}
+
+	// Without since only new messages count.
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/messages/qa/wait?subject=welcome&timeout=2s", nil))
+		done <- rec
+	}()
+	time.Sleep(50 * time.Millisecond)
+	_, _ = store.Save("qa@tmp.local", storage.Message{Subject: "Something else"})
+	live, _ := store.Save("qa@tmp.local", storage.Message{Subject: "Welcome aboard"})
+	rec = <-done
+	got = storage.Message{}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil || got.ID != live.ID {
+		t.Fatalf("live: code=%d id=%q err=%v", rec.Code, got.ID, err)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/messages/qa/wait?from=nobody&timeout=50ms", nil))
+	if rec.Code != http.StatusRequestTimeout {
+		t.Fatalf("want 408, got %d", rec.Code)
+	}
+}
+
+func TestMailboxToken(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	mux := NewMux(store, testDomains(t), nil, Options{})
+
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/address?local=owner", nil))
+	var created struct {
+		Local string `json:"local"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || created.Token == "" {
+		t.Fatalf("create: code=%d err=%v", rec.Code, err)
+	}
+
+	cases := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"no token", httptest.NewRequest(http.MethodGet, "/api/messages/owner", nil), http.StatusUnauthorized},
+		{"wrong token", httptest.NewRequest(http.MethodGet, "/api/messages/owner?token=nope", nil), http.StatusUnauthorized},
+		{"query token", httptest.NewRequest(http.MethodGet, "/api/messages/owner?token="+created.Token, nil), http.StatusOK},
+		{"claim taken", httptest.NewRequest(http.MethodPost, "/api/address?local=owner", nil), http.StatusConflict},
+		{"delete without token", httptest.NewRequest(http.MethodDelete, "/api/address/owner", nil), http.StatusUnauthorized},
+		{"clear without token", httptest.NewRequest(http.MethodDelete, "/api/messages/owner", nil), http.StatusUnauthorized},
+		{"extend without token", httptest.NewRequest(http.MethodPost, "/api/address/owner/extend", nil), http.StatusUnauthorized},
+		{"extend", httptest.NewRequest(http.MethodPost, "/api/address/owner/extend?ttl=1h&token="+created.Token, nil), http.StatusOK},
+		{"extend bad ttl", httptest.NewRequest(http.MethodPost, "/api/address/owner/extend?ttl=soon&token="+created.Token, nil), http.StatusBadRequest},
+		{"full address", httptest.NewRequest(http.MethodGet, "/api/messages/owner@tmp.local?token="+created.Token, nil), http.StatusOK},
+		{"unknown domain", httptest.NewRequest(http.MethodPost, "/api/address?local=x&domain=nope.test", nil), http.StatusBadRequest},
+		{"closed domain", httptest.NewRequest(http.MethodPost, "/api/address?local=x&domain=closed.test", nil), http.StatusForbidden},
+		{"domains", httptest.NewRequest(http.MethodGet, "/api/domains", nil), http.StatusOK},
+		{"delete missing message", httptest.NewRequest(http.MethodDelete, "/api/messages/owner/nope?token="+created.Token, nil), http.StatusNotFound},
+	}
+	header := httptest.NewRequest(http.MethodGet, "/api/messages/owner", nil)
+	header.Header.Set("X-Mailbox-Token", created.Token)
+	cases = append(cases, struct {
+		name string
+		req  *http.Request
+		want int
+	}{"header token", header, http.StatusOK})
+
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, c.req)
+		if rec.Code != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, rec.Code, c.want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/api/address/owner?token="+created.Token, nil))
+	if rec.Code != http.StatusNoContent || store.AddressExists("owner@tmp.local") {
+		t.Fatalf("delete mailbox: got %d", rec.Code)
+	}
+}
+
+func TestMessages_MethodNotAllowed(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	mux := NewMux(store, testDomains(t), nil, Options{OpenMode: true})
+	store.CreateAddress("owner@tmp.local")
+
+	cases := []struct {
+		method, path, allow string
+	}{
+		{http.MethodPost, "/api/messages/owner", "GET, DELETE"},
+		{http.MethodDelete, "/api/messages/owner/events", "GET"},
+		{http.MethodPost, "/api/messages/owner/wait", "GET"},
+		{http.MethodPut, "/api/messages/owner/some-id", "GET, DELETE"},
+		{http.MethodDelete, "/api/messages/owner/some-id/extract", "GET"},
+		{http.MethodDelete, "/api/messages/owner/some-id/attachments/0", "GET"},
+		{http.MethodGet, "/api/address/owner/extend", "POST"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != c.allow {
+			t.Errorf("%s %s: got %d Allow=%q, want 405 Allow=%q", c.method, c.path, rec.Code, rec.Header().Get("Allow"), c.allow)
+		}
+	}
+}
+
+func TestMailboxClaim(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	mux := NewMux(store, testDomains(t), nil, Options{})
+	// Mailboxes created by incoming mail have a token nobody has seen yet.
+	reserved := store.ReserveAddress("inbox@tmp.local")
+
+	claim := func() (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/address?local=inbox", nil))
+		var got struct {
+			Token string `json:"token"`
+		}
+		json.NewDecoder(rec.Body).Decode(&got)
+		return rec.Code, got.Token
+	}
+	if code, token := claim(); code != http.StatusOK || token != reserved.Token {
+		t.Fatalf("first claim: got %d %q", code, token)
+	}
+	if code, _ := claim(); code != http.StatusConflict {
+		t.Fatalf("second claim: got %d", code)
+	}
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/messages/inbox?token="+reserved.Token, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("read with claimed token: got %d", rec.Code)
+	}
+}
+
+func TestEnvelopeHTML_FlagsMismatch(t *testing.T) {
+	msg := storage.Message{
+		From:     "Brand <news@brand.example>",
+		Envelope: &storage.Envelope{MailFrom: "bounces@esp.example", RcptTo: []string{"a@tmp.local"}, RemoteIP: "192.0.2.1", Helo: "esp.example"},
+	}
+	if out := envelopeHTML(msg); !strings.Contains(out, "mismatch") || !strings.Contains(out, "esp.example [192.0.2.1]") {
+		t.Fatalf("mismatch not flagged: %s", out)
+	}
+	msg.Envelope.MailFrom = "NEWS@brand.example"
+	if out := envelopeHTML(msg); strings.Contains(out, "mismatch") {
+		t.Fatalf("matching sender flagged: %s", out)
+	}
+}
+
+// acceptAll is an outbound transport that delivers nothing and never fails.
+type acceptAll struct{}
+
+func (acceptAll) Build(msg smtpclient.Message) ([]byte, error) {
+	return []byte("Subject: " + msg.Subject + "\r\n\r\n" + msg.Body + "\r\n"), nil
+}
+
+func (acceptAll) Deliver(context.Context, string, string, []string, []byte) error { return nil }
+
+func TestSend_Queued(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	outbox, err := outbound.New(outbound.Config{Dir: t.TempDir()}, acceptAll{}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outbox.Close()
+	mux := NewMux(store, testDomains(t), outbox, Options{})
+
+	send := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(body)))
+		return rec
+	}
+	rec := send(`{"from":"me","to":["you@example.com"],"subject":"s","body":"b"}`)
+	var queued struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Token  string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&queued); err != nil || rec.Code != http.StatusAccepted || queued.ID == "" {
+		t.Fatalf("send: code=%d err=%v", rec.Code, err)
+	}
+	// The sender mailbox was created by this request, so its token comes back.
+	a, _ := store.GetAddress("me@tmp.local")
+	if queued.Token != a.Token || a.Unclaimed {
+		t.Fatalf("send returned token %q for %+v", queued.Token, a)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/send/"+queued.ID, nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("status without token: got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/send?token="+a.Token, strings.NewReader(`{"from":"me","to":["nodomain"],"subject":"s","body":"b"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("bad recipient: got %d", rec.Code)
+	}
+	var item outbound.Item
+	for deadline := time.Now().Add(5 * time.Second); item.Status != outbound.StatusSent && time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		rec = httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/send/"+queued.ID+"?token="+a.Token, nil))
+		if err := json.NewDecoder(rec.Body).Decode(&item); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("status: code=%d err=%v", rec.Code, err)
+		}
+	}
+	if item.Status != outbound.StatusSent || item.Recipients[0].Address != "you@example.com" {
+		t.Fatalf("final status %+v", item)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/send/unknown", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown id: got %d", rec.Code)
+	}
+}
+
+func TestDomainDNS(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	keys := dkimkeys.NewKeyring(t.TempDir())
+	key, err := keys.Add("tmp.local", "mail", dkimkeys.RSA, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewMux(store, testDomains(t), nil, Options{DKIM: keys})
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec
+	}
+
+	rec := get("/api/domains/TMP.local/dns")
+	var records []dnsRecord
+	if err := json.NewDecoder(rec.Body).Decode(&records); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("dns: code=%d err=%v", rec.Code, err)
+	}
+	want := map[string]string{"spf": "tmp.local", "dkim": "mail._domainkey.tmp.local", "dmarc": "_dmarc.tmp.local"}
+	for _, r := range records {
+		if want[r.Purpose] != r.Name {
+			t.Errorf("%s record at %s", r.Purpose, r.Name)
+		}
+		delete(want, r.Purpose)
+		if r.Purpose == "dkim" && r.Value != key.Record() {
+			t.Errorf("dkim value %q", r.Value)
+		}
+	}
+	if len(want) != 0 {
+		t.Fatalf("missing records: %v", want)
+	}
+
+	// The zone form splits the 2048-bit key into 255-byte strings.
+	zone := get("/api/domains/tmp.local/dns?format=zone").Body.String()
+	for _, line := range strings.Split(strings.TrimSpace(zone), "\n") {
+		if strings.HasPrefix(line, "mail._domainkey.tmp.local.\tIN\tTXT\t\"v=DKIM1") {
+			if !strings.Contains(line, `" "`) {
+				t.Fatalf("dkim value not split: %s", line)
+			}
+			return
+		}
+	}
+	t.Fatalf("no dkim line in zone:\n%s", zone)
+}
+
+func TestDomainDNS_SPF(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	for spf, want := range map[string]string{"": "v=spf1 mx ~all", "v=spf1 mx a:relay.example ~all": "v=spf1 mx a:relay.example ~all"} {
+		rec := httptest.NewRecorder()
+		NewMux(store, testDomains(t), nil, Options{SPF: spf}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/domains/tmp.local/dns", nil))
+		var records []dnsRecord
+		json.NewDecoder(rec.Body).Decode(&records)
+		if len(records) == 0 || records[0].Purpose != "spf" || records[0].Value != want {
+			t.Errorf("SPF %q: got %+v", spf, records)
+		}
+	}
+}
+
+func TestDomainDNS_Unknown(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	mux := NewMux(store, testDomains(t), nil, Options{})
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/domains/example.org/dns", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown domain: got %d", rec.Code)
+	}
+}
+
+// captureBuild validates and records the messages handed to the transport.
+type captureBuild struct {
+	acceptAll
+	msgs *[]smtpclient.Message
+}
+
+func (c captureBuild) Build(msg smtpclient.Message) ([]byte, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	*c.msgs = append(*c.msgs, msg)
+	return c.acceptAll.Build(msg)
+}
+
+// captureMux serves the API in open mode with a send queue whose transport
+// records every message into the returned slice.
+func captureMux(t *testing.T) (http.Handler, *[]smtpclient.Message) {
+	t.Helper()
+	store := storage.NewMemoryStore(time.Minute)
+	t.Cleanup(store.Close)
+	got := new([]smtpclient.Message)
+	outbox, err := outbound.New(outbound.Config{Dir: t.TempDir()}, captureBuild{msgs: got}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { outbox.Close() })
+	return NewMux(store, testDomains(t), outbox, Options{OpenMode: true}), got
+}
+
+func TestSend_Attachments(t *testing.T) {
+	mux, got := captureMux(t)
+	post := func(ct string, body io.Reader) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/send", body)
+		req.Header.Set("Content-Type", ct)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// JSON with base64 content.
+	code := post("application/json", strings.NewReader(`{"from":"me","to":["you@example.com"],"subject":"s","html":"<img src=\"cid:a@x\">",
+		"attachments":[{"filename":"a.png","contentId":"a@x","content":"iVBORw0K"}]}`))
+	if code != http.StatusAccepted || len(*got) != 1 || (*got)[0].Attachments[0].ContentID != "a@x" || string((*got)[0].Attachments[0].Data) != "\x89PNG\r\n" {
+		t.Fatalf("json: code=%d %+v", code, *got)
+	}
+	for _, bad := range []string{`{"content":"!!"}`, `{"contentType":"text/plain\r\nBcc: x@evil.example","content":""}`} {
+		body := `{"from":"me","to":["you@example.com"],"subject":"s","body":"b","attachments":[` + bad + `]}`
+		if code := post("application/json", strings.NewReader(body)); code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d", bad, code)
+		}
+	}
+
+	// Multipart form with an attachment and an inline image.
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range map[string]string{"from": "me", "fromName": "Me", "subject": "s", "body": "b", "html": "<p>x</p>"} {
+		mw.WriteField(k, v)
+	}
+	mw.WriteField("to", "a@example.com")
+	mw.WriteField("to", "B <b@example.com>")
+	fw, _ := mw.CreateFormFile("attachments", "notes.txt")
+	fw.Write([]byte("hello"))
+	fw, _ = mw.CreateFormFile("inline", "logo@app.png")
+	fw.Write([]byte("png"))
+	mw.Close()
+	if code := post(mw.FormDataContentType(), &buf); code != http.StatusAccepted || len(*got) != 2 {
+		t.Fatalf("multipart: code=%d", code)
+	}
+	m := (*got)[1]
+	if m.FromName != "Me" || len(m.To) != 2 || len(m.Attachments) != 2 ||
+		m.Attachments[0].Filename != "notes.txt" || string(m.Attachments[0].Data) != "hello" || m.Attachments[0].ContentID != "" ||
+		m.Attachments[1].ContentID != "logo@app.png" || m.Attachments[1].ContentType != "" {
+		t.Fatalf("multipart message %+v", m)
+	}
+}
+
+func TestSend_Headers(t *testing.T) {
+	mux, got := captureMux(t)
+	send := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/send", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := send(`{"from":"me","bcc":["a@example.com"],"cc":["b@example.com"],"replyTo":["r@example.com"],
+		"inReplyTo":"<x@example.com>","references":["<x@example.com>"],"headers":{"X-Run":"7"},"subject":"s","body":"b"}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("send: %d %s", rec.Code, rec.Body)
+	}
+	var id struct{ ID string }
+	json.NewDecoder(rec.Body).Decode(&id)
+	var item struct {
+		Recipients []struct{ Address string } `json:"recipients"`
+	}
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/send/"+id.ID, nil))
+	if err := json.NewDecoder(rec.Body).Decode(&item); err != nil || len(item.Recipients) != 2 {
+		t.Fatalf("item: %v %+v", err, item)
+	}
+	m := (*got)[0]
+	if len(m.Bcc) != 1 || len(m.Cc) != 1 || m.ReplyTo[0] != "r@example.com" || m.InReplyTo != "<x@example.com>" || m.Headers["X-Run"] != "7" {
+		t.Fatalf("message %+v", m)
+	}
+
+	// Only X- headers may be set, each name once.
+	for _, bad := range []string{`{"Bcc":"x@example.com"}`, `{"X-Run":"1","x-run":"2"}`} {
+		if rec := send(`{"from":"me","to":["a@example.com"],"headers":` + bad + `,"subject":"s","body":"b"}`); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: got %d", bad, rec.Code)
+		}
+	}
+}
+
+func TestServeAttachment_InlineAllowlist(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	store.CreateAddress("owner@tmp.local")
+	raw := "Subject: a\r\nContent-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/plain\r\n\r\nhi\r\n" +
+		"--b\r\nContent-Type: text/html\r\nContent-Disposition: attachment; filename=x.html\r\n\r\n<script>alert(1)</script>\r\n" +
+		"--b\r\nContent-Type: image/png\r\nContent-Disposition: attachment; filename=x.png\r\n\r\nPNG\r\n" +
+		"--b--\r\n"
+	msg, err := store.Save("owner@tmp.local", storage.Message{Raw: []byte(raw)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := NewMux(store, testDomains(t), nil, Options{OpenMode: true})
+	for n, want := range []string{"attachment", "inline"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/api/messages/owner/%s/attachments/%d?inline=1", msg.ID, n), nil))
+		if got := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(got, want+";") {
+			t.Errorf("attachment %d: disposition %q, want %s", n, got, want)
+		}
+		if rec.Header().Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("attachment %d: no sandbox CSP", n)
+		}
+	}
+}
+
+func TestInlineContentIDs(t *testing.T) {
+	raw := "Content-Type: multipart/related; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<p>html</p>\r\n" +
+		"--b\r\nContent-Type: image/png\r\nContent-ID: <logo@x>\r\n\r\nPNG\r\n" +
+		"--b\r\nContent-Type: text/html\r\nContent-ID: <page@x>\r\n\r\n<script>alert(1)</script>\r\n" +
+		"--b\r\nContent-Type: image/svg+xml\r\nContent-ID: <svg@x>\r\n\r\n<svg/>\r\n" +
+		"--b\r\nContent-Type: image/x\"><script>; =\r\nContent-ID: <evil@x>\r\n\r\nx\r\n" +
+		"--b--\r\n"
+	root, err := mimeparse.Parse([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := inlineContentIDs(root, `<img src="cid:logo@x"><iframe src="cid:page@x"></iframe><img src="cid:svg@x"><img src="cid:evil@x"><img src="cid:missing@x">`)
+	want := `<img src="data:image/png;base64,UE5H"><iframe src=""></iframe><img src=""><img src=""><img src="">`
+	if got != want {
+		t.Fatalf("got %s", got)
+	}
+}
@@ -0,0 +1,115 @@
+package httpapi
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"temp_mail/internal/smtpclient"
+)
+
+// maxSendBytes caps a /api/send request, attachments included.
+const maxSendBytes = 25 << 20
+
+// sendRequest is the body of /api/send, sent as JSON or multipart/form-data.
+type sendRequest struct {
+	From        string            `json:"from"`       // 发件人本地部分（如 "test"，拼接默认域名）或本实例域名下的完整地址
+	FromName    string            `json:"fromName"`   // 发件人显示名（可选）
+	To          []string          `json:"to"`         // 收件人列表（完整邮箱地址，可带显示名）
+	Cc          []string          `json:"cc"`         // 抄送
+	Bcc         []string          `json:"bcc"`        // 密送，不出现在邮件头中
+	ReplyTo     []string          `json:"replyTo"`    // Reply-To
+	InReplyTo   string            `json:"inReplyTo"`  // 被回复邮件的 Message-ID
+	References  []string          `json:"references"` // 会话中各邮件的 Message-ID
+	Headers     map[string]string `json:"headers"`    // 自定义 X- 头
+	Subject     string            `json:"subject"`    // 邮件主题
+	Body        string            `json:"body"`       // 邮件正文
+	HTML        string            `json:"html"`       // HTML正文（可选）
+	Attachments []sendAttachment  `json:"attachments"`
+}
+
+// sendAttachment is a JSON attachment; Content is base64.
+type sendAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	ContentID   string `json:"contentId"`
+	Content     string `json:"content"`
+}
+
+// decodeSendRequest reads a JSON body, or a multipart form whose files under
+// "attachments" are attached and whose files under "inline" are embedded,
+// with their Content-ID part header, or else their filename, as Content-ID.
+// Form fields named X-* become custom headers.
+func decodeSendRequest(w http.ResponseWriter, r *http.Request) (sendRequest, []smtpclient.Attachment, error) {
+	var req sendRequest
+	r.Body = http.MaxBytesReader(w, r.Body, maxSendBytes)
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "multipart/form-data" {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return req, nil, err
+		}
+		var files []smtpclient.Attachment
+		for i, a := range req.Attachments {
+			data, err := base64.StdEncoding.DecodeString(a.Content)
+			if err != nil {
+				return req, nil, fmt.Errorf("attachments[%d]: %v", i, err)
+			}
+			files = append(files, smtpclient.Attachment{
+				Filename: a.Filename, ContentType: a.ContentType, ContentID: a.ContentID, Data: data,
+			})
+		}
+		return req, files, nil
+	}
+
+	if err := r.ParseMultipartForm(maxSendBytes); err != nil {
+		return req, nil, err
+	}
+	f := r.MultipartForm
+	get := func(k string) string {
+		if v := f.Value[k]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	req.From, req.FromName, req.Subject = get("from"), get("fromName"), get("subject")
+	req.Body, req.HTML, req.To = get("body"), get("html"), f.Value["to"]
+	req.Cc, req.Bcc, req.ReplyTo = f.Value["cc"], f.Value["bcc"], f.Value["replyTo"]
+	req.InReplyTo, req.References = get("inReplyTo"), f.Value["references"]
+	for k, v := range f.Value {
+		if len(k) > 2 && strings.EqualFold(k[:2], "x-") {
+			if req.Headers == nil {
+				req.Headers = make(map[string]string)
+			}
+			req.Headers[k] = v[0]
+		}
+	}
+
+	var files []smtpclient.Attachment
+	for _, field := range []string{"attachments", "inline"} {
+		for _, fh := range f.File[field] {
+			file, err := fh.Open()
+			if err != nil {
+				return req, nil, err
+			}
+			data, err := io.ReadAll(file)
+			file.Close()
+			if err != nil {
+				return req, nil, err
+			}
+			a := smtpclient.Attachment{Filename: fh.Filename, ContentType: fh.Header.Get("Content-Type"), Data: data}
+			if a.ContentType == "application/octet-stream" {
+				a.ContentType = "" // 客户端的默认值，改按扩展名推断
+			}
+			if field == "inline" {
+				a.ContentID = cmp.Or(fh.Header.Get("Content-Id"), fh.Filename)
+			}
+			files = append(files, a)
+		}
+	}
+	return req, files, nil
+}
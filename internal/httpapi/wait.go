@@ -0,0 +1,119 @@
+package httpapi
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"temp_mail/internal/mimeparse"
+	"temp_mail/internal/storage"
+)
+
+const (
+	defaultWaitTimeout = 30 * time.Second
+	maxWaitTimeout     = 5 * time.Minute
+)
+
+// messageFilter holds the case-insensitive match criteria of the wait
+// endpoint. Empty fields match everything.
+type messageFilter struct {
+	from     string
+	subject  string
+	contains string
+}
+
+func (f messageFilter) match(msg storage.Message) bool {
+	if f.from != "" && !strings.Contains(strings.ToLower(msg.From), f.from) {
+		return false
+	}
+	if f.subject != "" && !strings.Contains(strings.ToLower(msg.Subject), f.subject) {
+		return false
+	}
+	if f.contains != "" {
+		return strings.Contains(strings.ToLower(searchableText(msg)), f.contains)
+	}
+	return true
+}
+
+// searchableText is the subject plus the decoded text and HTML bodies.
+func searchableText(msg storage.Message) string {
+	root, err := mimeparse.Parse(msg.Raw)
+	if err != nil {
+		return msg.Subject + "\n" + string(msg.Raw)
+	}
+	return msg.Subject + "\n" + root.Text() + "\n" + mimeparse.StripHTML(root.HTML())
+}
+
+// parseSince accepts an RFC 3339 timestamp or a duration meaning "that long
+// ago" (e.g. since=2m).
+func parseSince(v string, now time.Time) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, true
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), true
+	}
+	return time.Time{}, false
+}
+
+// serveWait blocks until a message matching the query is saved to mailbox and
+// returns it as JSON, or answers 408 once the timeout expires. With since,
+// messages that arrived from that moment on also count, so a client that
+// triggers a mail and then calls wait cannot miss it.
+func serveWait(w http.ResponseWriter, r *http.Request, store storage.Store, mailbox string) {
+	q := r.URL.Query()
+	filter := messageFilter{
+		from:     strings.ToLower(q.Get("from")),
+		subject:  strings.ToLower(q.Get("subject")),
+		contains: strings.ToLower(q.Get("contains")),
+	}
+	timeout := defaultWaitTimeout
+	if v := q.Get("timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]interface{}{"error": "invalid timeout"})
+			return
+		}
+		timeout = min(d, maxWaitTimeout)
+	}
+
+	// Subscribe first so a message saved while we scan the mailbox is not lost.
+	ch, cancel := store.Subscribe(mailbox)
+	defer cancel()
+
+	if v := q.Get("since"); v != "" {
+		since, ok := parseSince(v, time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]interface{}{"error": "invalid since"})
+			return
+		}
+		msgs := store.List(mailbox)
+		// List is newest first; return the oldest match.
+		for i := len(msgs) - 1; i >= 0; i-- {
+			if !msgs[i].CreatedAt.Before(since) && filter.match(msgs[i]) {
+				writeJSON(w, msgs[i])
+				return
+			}
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-ch:
+			if filter.match(msg) {
+				writeJSON(w, msg)
+				return
+			}
+		case <-timer.C:
+			w.WriteHeader(http.StatusRequestTimeout)
+			writeJSON(w, map[string]interface{}{"error": "no matching message before timeout"})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
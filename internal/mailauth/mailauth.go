@@ -0,0 +1,276 @@
+// Package mailauth verifies SPF, DKIM and DMARC on received messages and
+// renders the outcome as an Authentication-Results header (RFC 8601).
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Resolver is the DNS subset the checks need. *net.Resolver implements it;
+// tests pass a fake to run offline.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Result values, as used in Authentication-Results.
+const (
+	Pass      = "pass"
+	Fail      = "fail"
+	SoftFail  = "softfail"
+	Neutral   = "neutral"
+	None      = "none"
+	TempError = "temperror"
+	PermError = "permerror"
+)
+
+// Result is the outcome of one check.
+type Result struct {
+	Result string `json:"result"`
+	// Domain is the identity that was checked: the MAIL FROM (or HELO)
+	// domain for SPF, the d= of a DKIM signature, the header From domain
+	// for DMARC.
+	Domain string `json:"domain,omitempty"`
+	// Policy is the published DMARC p= of the From domain.
+	Policy string `json:"policy,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Results holds all checks for one message.
+type Results struct {
+	SPF Result `json:"spf"`
+	// DKIM has one entry per signature, in header order; empty when the
+	// message is unsigned.
+	DKIM  []Result `json:"dkim"`
+	DMARC Result   `json:"dmarc"`
+}
+
+// Verifier runs the checks against a resolver.
+type Verifier struct {
+	resolver Resolver
+}
+
+// NewVerifier returns a verifier using r, or net.DefaultResolver when r is
+// nil.
+func NewVerifier(r Resolver) *Verifier {
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	return &Verifier{resolver: r}
+}
+
+// Verify checks a message received from ip with the given HELO name and
+// MAIL FROM. raw must be the message as received, before any trace headers
+// are added.
+func (v *Verifier) Verify(ctx context.Context, ip net.IP, helo, mailFrom string, raw []byte) *Results {
+	res := &Results{
+		SPF:  v.checkSPF(ctx, ip, helo, mailFrom),
+		DKIM: v.checkDKIM(ctx, raw),
+	}
+	res.DMARC = v.checkDMARC(ctx, raw, res.SPF, res.DKIM)
+	return res
+}
+
+func (v *Verifier) checkSPF(ctx context.Context, ip net.IP, helo, mailFrom string) Result {
+	r := Result{Domain: domainOf(mailFrom)}
+	if r.Domain == "" {
+		r.Domain = strings.ToLower(helo)
+	}
+	if ip == nil || r.Domain == "" {
+		return Result{Result: None, Domain: r.Domain, Reason: "no sender identity"}
+	}
+	result, err := spf.CheckHostWithSender(ip, helo, mailFrom, spf.WithResolver(v.resolver), spf.WithContext(ctx))
+	r.Result = string(result)
+	if err != nil {
+		r.Reason = err.Error()
+	}
+	return r
+}
+
+func (v *Verifier) checkDKIM(ctx context.Context, raw []byte) []Result {
+	verifs, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{
+		LookupTXT:        func(name string) ([]string, error) { return v.resolver.LookupTXT(ctx, name) },
+		MaxVerifications: 5,
+	})
+	if err != nil && len(verifs) == 0 {
+		return []Result{{Result: PermError, Reason: err.Error()}}
+	}
+	out := make([]Result, 0, len(verifs))
+	for _, verif := range verifs {
+		r := Result{Result: Pass, Domain: strings.ToLower(verif.Domain)}
+		switch {
+		case verif.Err == nil:
+		case dkim.IsTempFail(verif.Err):
+			r.Result = TempError
+		case dkim.IsPermFail(verif.Err):
+			r.Result = PermError
+		default:
+			r.Result = Fail
+		}
+		if verif.Err != nil {
+			r.Reason = verif.Err.Error()
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+func (v *Verifier) checkDMARC(ctx context.Context, raw []byte, spfRes Result, dkimRes []Result) Result {
+	from, err := headerFromDomain(raw)
+	if err != nil {
+		return Result{Result: PermError, Reason: err.Error()}
+	}
+	r := Result{Domain: from}
+	opts := &dmarc.LookupOptions{
+		LookupTXT: func(name string) ([]string, error) { return v.resolver.LookupTXT(ctx, name) },
+	}
+	record, err := dmarc.LookupWithOptions(from, opts)
+	if err == dmarc.ErrNoPolicy {
+		if org := orgDomain(from); org != from {
+			record, err = dmarc.LookupWithOptions(org, opts)
+		}
+	}
+	switch {
+	case err == dmarc.ErrNoPolicy:
+		r.Result = None
+		r.Reason = "no DMARC record"
+		return r
+	case dmarc.IsTempFail(err):
+		r.Result = TempError
+		r.Reason = err.Error()
+		return r
+	case err != nil:
+		r.Result = PermError
+		r.Reason = err.Error()
+		return r
+	}
+	r.Policy = string(record.Policy)
+
+	if spfRes.Result == Pass && aligned(spfRes.Domain, from, record.SPFAlignment) {
+		r.Result = Pass
+		r.Reason = "SPF aligned"
+		return r
+	}
+	for _, d := range dkimRes {
+		if d.Result == Pass && aligned(d.Domain, from, record.DKIMAlignment) {
+			r.Result = Pass
+			r.Reason = "DKIM aligned (d=" + d.Domain + ")"
+			return r
+		}
+	}
+	r.Result = Fail
+	r.Reason = "no aligned SPF or DKIM pass"
+	return r
+}
+
+// Header renders the results as an Authentication-Results field for
+// authServID, including the trailing CRLF.
+func (r *Results) Header(authServID string) string {
+	results := []authres.Result{
+		&authres.SPFResult{Value: authres.ResultValue(r.SPF.Result), Reason: r.SPF.Reason, From: r.SPF.Domain},
+	}
+	if len(r.DKIM) == 0 {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultNone})
+	}
+	for _, d := range r.DKIM {
+		results = append(results, &authres.DKIMResult{Value: authres.ResultValue(d.Result), Reason: d.Reason, Domain: d.Domain})
+	}
+	results = append(results, &authres.DMARCResult{Value: authres.ResultValue(r.DMARC.Result), Reason: r.DMARC.Reason, From: r.DMARC.Domain})
+	return "Authentication-Results: " + strings.ReplaceAll(authres.Format(authServID, results), "; ", ";\r\n\t") + "\r\n"
+}
+
+// StripResults removes the Authentication-Results fields in the header of raw
+// that claim authServID, so results forged by the sender cannot pass for
+// ours (RFC 8601 section 5). Fields of other authserv-ids are kept.
+func StripResults(raw []byte, authServID string) []byte {
+	out := make([]byte, 0, len(raw))
+	rest := raw
+	for len(rest) > 0 && rest[0] != '\r' && rest[0] != '\n' {
+		// A field runs up to the next line that does not start with WSP.
+		n := 0
+		for {
+			i := bytes.IndexByte(rest[n:], '\n')
+			if i < 0 {
+				n = len(rest)
+				break
+			}
+			n += i + 1
+			if n == len(rest) || (rest[n] != ' ' && rest[n] != '\t') {
+				break
+			}
+		}
+		if !claimsResults(rest[:n], authServID) {
+			out = append(out, rest[:n]...)
+		}
+		rest = rest[n:]
+	}
+	return append(out, rest...)
+}
+
+// claimsResults reports whether field is an Authentication-Results field
+// whose authserv-id is authServID.
+func claimsResults(field []byte, authServID string) bool {
+	name, value, ok := bytes.Cut(field, []byte(":"))
+	if !ok || !strings.EqualFold(string(bytes.TrimSpace(name)), "Authentication-Results") {
+		return false
+	}
+	id, _, _ := strings.Cut(string(value), ";")
+	f := strings.Fields(id) // authserv-id [version]
+	return len(f) > 0 && strings.EqualFold(f[0], authServID)
+}
+
+// aligned reports whether domain d aligns with the From domain under mode:
+// strict needs an exact match, relaxed (the default) the same
+// organizational domain.
+func aligned(d, from string, mode dmarc.AlignmentMode) bool {
+	if d == "" {
+		return false
+	}
+	if strings.EqualFold(d, from) {
+		return true
+	}
+	return mode != dmarc.AlignmentStrict && orgDomain(d) == orgDomain(from)
+}
+
+func orgDomain(d string) string {
+	if org, err := publicsuffix.EffectiveTLDPlusOne(d); err == nil {
+		return org
+	}
+	return d
+}
+
+func headerFromDomain(raw []byte) (string, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return "", fmt.Errorf("unreadable header: %v", err)
+	}
+	list, err := msg.Header.AddressList("From")
+	if err != nil || len(list) != 1 {
+		return "", fmt.Errorf("need exactly one From address")
+	}
+	d := domainOf(list[0].Address)
+	if d == "" {
+		return "", fmt.Errorf("From address has no domain")
+	}
+	return d, nil
+}
+
+func domainOf(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return strings.ToLower(addr[i+1:])
+	}
+	return ""
+}
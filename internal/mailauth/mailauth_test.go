@@ -0,0 +1,116 @@
+package mailauth
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+// fakeResolver answers TXT queries from a map and reports everything else
+// as not found.
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := f[strings.TrimSuffix(name, ".")]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (f fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func signed(t *testing.T, key ed25519.PrivateKey, domain, msg string) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	err := dkim.Sign(&out, strings.NewReader(msg), &dkim.SignOptions{
+		Domain:   domain,
+		Selector: "s1",
+		Signer:   key,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns := fakeResolver{
+		"brand.example":               {"v=spf1 ip4:192.0.2.10 -all"},
+		"esp.example":                 {"v=spf1 ip4:198.51.100.7 -all"},
+		"s1._domainkey.brand.example": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+		"_dmarc.brand.example":        {"v=DMARC1; p=reject"},
+	}
+	v := NewVerifier(dns)
+	msg := "From: News <news@mail.brand.example>\r\nTo: a@tmp.local\r\nSubject: hi\r\n\r\nhello\r\n"
+
+	cases := []struct {
+		name            string
+		ip              string
+		mailFrom        string
+		raw             []byte
+		spf, dkim, dmrc string
+	}{
+		{"spf aligned via org domain", "192.0.2.10", "bounce@brand.example", []byte(msg), Pass, "", Pass},
+		{"dkim aligned, foreign bounce domain", "198.51.100.7", "b@esp.example", signed(t, key, "brand.example", msg), Pass, Pass, Pass},
+		{"spf fail and tampered body", "203.0.113.1", "bounce@brand.example",
+			bytes.Replace(signed(t, key, "brand.example", msg), []byte("hello"), []byte("jello"), 1), Fail, Fail, Fail},
+	}
+	for _, tc := range cases {
+		res := v.Verify(context.Background(), net.ParseIP(tc.ip), "mx.test", tc.mailFrom, tc.raw)
+		if res.SPF.Result != tc.spf {
+			t.Errorf("%s: spf = %+v, want %s", tc.name, res.SPF, tc.spf)
+		}
+		if tc.dkim == "" && len(res.DKIM) != 0 || tc.dkim != "" && (len(res.DKIM) != 1 || res.DKIM[0].Result != tc.dkim) {
+			t.Errorf("%s: dkim = %+v, want %q", tc.name, res.DKIM, tc.dkim)
+		}
+		if res.DMARC.Result != tc.dmrc || res.DMARC.Policy != "reject" || res.DMARC.Domain != "mail.brand.example" {
+			t.Errorf("%s: dmarc = %+v, want %s", tc.name, res.DMARC, tc.dmrc)
+		}
+	}
+
+	res := v.Verify(context.Background(), net.ParseIP("192.0.2.10"), "mx.test", "bounce@brand.example", []byte(msg))
+	h := res.Header("tmp.local")
+	for _, want := range []string{"Authentication-Results: tmp.local;", "spf=pass", "smtp.mailfrom=brand.example", "dkim=none", "dmarc=pass", "header.from=mail.brand.example"} {
+		if !strings.Contains(h, want) {
+			t.Errorf("header lacks %q: %s", want, h)
+		}
+	}
+}
+
+func TestStripResults(t *testing.T) {
+	raw := "Authentication-Results: TMP.local; spf=pass\r\n" +
+		"Subject: hi\r\n" +
+		"Authentication-Results: mx.other.example 1;\r\n\tdkim=pass\r\n" +
+		"Authentication-Results:\r\n\ttmp.local 1; dmarc=pass\r\n" +
+		"From: a@b.example\r\n" +
+		"\r\n" +
+		"Authentication-Results: tmp.local; body text\r\n"
+	want := "Subject: hi\r\n" +
+		"Authentication-Results: mx.other.example 1;\r\n\tdkim=pass\r\n" +
+		"From: a@b.example\r\n" +
+		"\r\n" +
+		"Authentication-Results: tmp.local; body text\r\n"
+	if got := string(StripResults([]byte(raw), "tmp.local")); got != want {
+		t.Fatalf("got:\n%s", got)
+	}
+}
@@ -0,0 +1,75 @@
+package mimeparse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/simplifiedchinese"
+)
+
+// lookupCharset resolves a MIME charset label to an encoding. It knows the
+// WHATWG labels (gbk, gb2312, big5, iso-2022-jp, shift_jis, euc-kr,
+// windows-125x, ...) and falls back to the IANA registry.
+func lookupCharset(label string) (encoding.Encoding, error) {
+	label = strings.ToLower(strings.Trim(strings.TrimSpace(label), `"`))
+	switch label {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		return nil, nil
+	case "gb2312", "gbk", "x-gbk", "cp936":
+		// Mailers label GB18030 text as GB2312/GBK all the time; the superset
+		// decodes all three.
+		return simplifiedchinese.GB18030, nil
+	}
+	if enc, err := htmlindex.Get(label); err == nil {
+		return enc, nil
+	}
+	if enc, err := ianaindex.MIME.Encoding(label); err == nil && enc != nil {
+		return enc, nil
+	}
+	return nil, fmt.Errorf("unsupported charset %q", label)
+}
+
+// charsetReader is the mime.WordDecoder hook for encoded-word headers.
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := lookupCharset(charset)
+	if err != nil {
+		return nil, err
+	}
+	if enc == nil {
+		return input, nil
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// toUTF8 converts b from charset to UTF-8. Unknown charsets and conversion
+// errors leave the bytes as they are.
+func toUTF8(charset string, b []byte) string {
+	enc, err := lookupCharset(charset)
+	if err != nil || enc == nil {
+		return string(b)
+	}
+	out, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return string(b)
+	}
+	return string(out)
+}
+
+// decodeRawHeader handles headers that carry unencoded 8-bit bytes, which
+// some legacy Chinese mailers still send: if the value is not UTF-8, try it
+// as GB18030.
+func decodeRawHeader(v string) string {
+	if utf8.ValidString(v) {
+		return v
+	}
+	if out, err := simplifiedchinese.GB18030.NewDecoder().Bytes([]byte(v)); err == nil && !bytes.ContainsRune(out, utf8.RuneError) {
+		return string(out)
+	}
+	return v
+}
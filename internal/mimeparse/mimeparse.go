@@ -0,0 +1,323 @@
+// Package mimeparse turns a raw RFC 5322 message into a tree of MIME parts
+// (RFC 2045/2046) with transfer encodings already removed. It is shared by
+// the SMTP server, which needs snippets, and the HTTP API, which renders the
+// message body.
+package mimeparse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	stdmail "net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// maxDepth bounds multipart nesting so a hostile message cannot recurse forever.
+const maxDepth = 32
+
+// Part is one node of a parsed message. The root Part carries the message
+// headers; leaves carry decoded bodies and multipart nodes carry children.
+type Part struct {
+	Header textproto.MIMEHeader
+	// MediaType is the lower-cased media type, e.g. "text/plain". Parts
+	// without a Content-Type default to text/plain, or message/rfc822 inside
+	// multipart/digest.
+	MediaType string
+	Params    map[string]string
+	// Disposition is "inline", "attachment" or empty.
+	Disposition       string
+	DispositionParams map[string]string
+	// Body is the body with Content-Transfer-Encoding removed, still in its
+	// declared charset (see DecodedText). It is empty for multipart parts.
+	Body  []byte
+	Parts []*Part
+}
+
+// Parse reads a full message. It only fails when the header block itself
+// cannot be read; malformed bodies degrade to a single text/plain part.
+func Parse(raw []byte) (*Part, error) {
+	msg, err := stdmail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parsePart(textproto.MIMEHeader(msg.Header), body, "text/plain", 0), nil
+}
+
+func parsePart(h textproto.MIMEHeader, body []byte, defaultType string, depth int) *Part {
+	p := &Part{Header: h, MediaType: defaultType, Params: map[string]string{}}
+	if ct := h.Get("Content-Type"); ct != "" {
+		if mt, params, err := mime.ParseMediaType(ct); err == nil {
+			p.MediaType = strings.ToLower(mt)
+			p.Params = params
+		} else if mt, _, _ := strings.Cut(ct, ";"); strings.Contains(mt, "/") {
+			// Keep the media type even if the parameters are broken.
+			p.MediaType = strings.ToLower(strings.TrimSpace(mt))
+		}
+	}
+	if cd := h.Get("Content-Disposition"); cd != "" {
+		if disp, params, err := mime.ParseMediaType(cd); err == nil {
+			p.Disposition = strings.ToLower(disp)
+			p.DispositionParams = params
+		} else {
+			d, _, _ := strings.Cut(cd, ";")
+			p.Disposition = strings.ToLower(strings.TrimSpace(d))
+		}
+	}
+
+	if strings.HasPrefix(p.MediaType, "multipart/") && depth < maxDepth {
+		if boundary := p.Params["boundary"]; boundary != "" {
+			childType := "text/plain"
+			if p.MediaType == "multipart/digest" {
+				childType = "message/rfc822"
+			}
+			p.Parts = parseMultipart(body, boundary, childType, depth)
+			if len(p.Parts) > 0 {
+				return p
+			}
+		}
+		// No boundary or no parts found: show the body as text rather than nothing.
+		p.MediaType = "text/plain"
+	}
+	p.Body = decodeTransfer(h.Get("Content-Transfer-Encoding"), body)
+	return p
+}
+
+func parseMultipart(body []byte, boundary, childType string, depth int) []*Part {
+	var parts []*Part
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		// NextRawPart keeps Content-Transfer-Encoding for decodeTransfer,
+		// NextPart would strip quoted-printable on its own.
+		mp, err := mr.NextRawPart()
+		if err != nil {
+			// io.EOF or a missing closing boundary: keep what was read.
+			break
+		}
+		data, err := io.ReadAll(mp)
+		if err != nil && len(data) == 0 {
+			break
+		}
+		parts = append(parts, parsePart(mp.Header, data, childType, depth+1))
+	}
+	return parts
+}
+
+func decodeTransfer(enc string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(enc)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			switch r {
+			case ' ', '\t', '\r', '\n':
+				return -1
+			}
+			return r
+		}, body)
+		out := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		if n, err := base64.StdEncoding.Decode(out, clean); err == nil {
+			return out[:n]
+		}
+		// Tolerate missing or stray padding.
+		if out, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(string(clean), "=")); err == nil {
+			return out
+		}
+		return body
+	case "quoted-printable":
+		out, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err != nil && len(out) == 0 {
+			return body
+		}
+		return out
+	default:
+		return body
+	}
+}
+
+// Walk calls fn for p and every descendant in document order. Returning
+// false from fn skips the children of that part.
+func (p *Part) Walk(fn func(*Part) bool) {
+	if !fn(p) {
+		return
+	}
+	for _, c := range p.Parts {
+		c.Walk(fn)
+	}
+}
+
+// IsMultipart reports whether p has child parts.
+func (p *Part) IsMultipart() bool { return len(p.Parts) > 0 }
+
+// Filename returns the attachment file name from Content-Disposition or the
+// legacy Content-Type name parameter.
+func (p *Part) Filename() string {
+	if name := p.DispositionParams["filename"]; name != "" {
+		return DecodeHeader(name)
+	}
+	if name := p.Params["name"]; name != "" {
+		return DecodeHeader(name)
+	}
+	return ""
+}
+
+// IsAttachment reports whether p is a leaf that is not rendered as message
+// text. Images embedded in the HTML body are such leaves too; Attachments,
+// which knows where a part sits, leaves them out.
+func (p *Part) IsAttachment() bool {
+	if p.IsMultipart() {
+		return false
+	}
+	if p.Disposition == "attachment" {
+		return true
+	}
+	return p.MediaType != "text/plain" && p.MediaType != "text/html"
+}
+
+// cidRef matches cid: URLs in an HTML body.
+var cidRef = regexp.MustCompile(`(?i)cid:([^"'\s>)]+)`)
+
+// Attachments returns the attachment parts in document order. Parts
+// embedded in the HTML body, those inside a multipart/related or referenced
+// through cid:, are left out unless marked Content-Disposition: attachment.
+// Other parts are listed even with a Content-ID, which some clients put on
+// every part.
+func (p *Part) Attachments() []*Part {
+	refs := make(map[string]bool)
+	for _, m := range cidRef.FindAllStringSubmatch(p.HTML(), -1) {
+		refs[m[1]] = true
+	}
+	var out []*Part
+	var walk func(c, parent *Part)
+	walk = func(c, parent *Part) {
+		for _, child := range c.Parts {
+			walk(child, c)
+		}
+		if !c.IsAttachment() {
+			return
+		}
+		embedded := (parent != nil && parent.MediaType == "multipart/related") ||
+			(c.ContentID() != "" && refs[c.ContentID()])
+		if c.Disposition == "attachment" || !embedded {
+			out = append(out, c)
+		}
+	}
+	walk(p, nil)
+	return out
+}
+
+// ContentID returns the Content-ID without angle brackets.
+func (p *Part) ContentID() string {
+	return strings.Trim(strings.TrimSpace(p.Header.Get("Content-Id")), "<>")
+}
+
+// Text returns the body of the first text/plain part that is not an attachment.
+func (p *Part) Text() string { return p.firstBody("text/plain") }
+
+// HTML returns the body of the first text/html part that is not an attachment.
+func (p *Part) HTML() string { return p.firstBody("text/html") }
+
+func (p *Part) firstBody(mediaType string) string {
+	var out string
+	found := false
+	p.Walk(func(c *Part) bool {
+		if found {
+			return false
+		}
+		if c.MediaType == mediaType && c.Disposition != "attachment" {
+			out = c.DecodedText()
+			found = true
+		}
+		return true
+	})
+	return out
+}
+
+// DecodedText returns the body converted from the declared charset to UTF-8.
+// Body itself keeps the original bytes so attachments download unchanged.
+func (p *Part) DecodedText() string {
+	return toUTF8(p.Params["charset"], p.Body)
+}
+
+// FindContentID returns the part referenced by a cid: URL, or nil.
+func (p *Part) FindContentID(cid string) *Part {
+	var hit *Part
+	p.Walk(func(c *Part) bool {
+		if hit == nil && !c.IsMultipart() && c.ContentID() == cid {
+			hit = c
+		}
+		return hit == nil
+	})
+	return hit
+}
+
+// DecodeHeader decodes RFC 2047 encoded-words in any supported charset to
+// UTF-8, returning v unchanged if it cannot be decoded.
+func DecodeHeader(v string) string {
+	dec := &mime.WordDecoder{CharsetReader: charsetReader}
+	if d, err := dec.DecodeHeader(v); err == nil {
+		return decodeRawHeader(d)
+	}
+	return decodeRawHeader(v)
+}
+
+// Snippet builds a short single-line preview from the text body, falling
+// back to the HTML body with tags removed. max counts runes.
+func Snippet(p *Part, max int) string {
+	t := p.Text()
+	if strings.TrimSpace(t) == "" {
+		t = StripHTML(p.HTML())
+	}
+	t = strings.Join(strings.Fields(t), " ")
+	if r := []rune(t); len(r) > max {
+		t = string(r[:max]) + "..."
+	}
+	return t
+}
+
+// StripHTML removes tags, together with the contents of <style>, <script>
+// and <head>, and unescapes entities.
+func StripHTML(s string) string {
+	var b strings.Builder
+	r := bufio.NewReader(strings.NewReader(s))
+	skipUntil := ""
+	for {
+		ch, _, err := r.ReadRune()
+		if err != nil {
+			break
+		}
+		if ch != '<' {
+			if skipUntil == "" {
+				b.WriteRune(ch)
+			}
+			continue
+		}
+		tag, err := r.ReadString('>')
+		if err != nil {
+			break
+		}
+		name := strings.ToLower(strings.TrimSpace(strings.TrimRight(tag, ">/")))
+		if i := strings.IndexAny(name, " \t\r\n"); i >= 0 {
+			name = name[:i]
+		}
+		switch {
+		case skipUntil != "":
+			if name == skipUntil {
+				skipUntil = ""
+			}
+		case name == "style" || name == "script" || name == "head":
+			skipUntil = "/" + name
+		case name == "br" || name == "/p" || name == "/div" || name == "/tr" || name == "/li":
+			b.WriteByte('\n')
+		}
+	}
+	return html.UnescapeString(b.String())
+}
@@ -0,0 +1,159 @@
+package mimeparse
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+)
+
+const nestedMessage = "From: shop@example.com\r\n" +
+	"Subject: =?UTF-8?B?5L2g5aW9?=\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"preamble\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"alt\"\r\n" +
+	"\r\n" +
+	"--alt\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Your order =\r\n" +
+	"is ready =E2=9C=93\r\n" +
+	"--alt\r\n" +
+	"Content-Type: multipart/related; boundary=\"rel\"\r\n" +
+	"\r\n" +
+	"--rel\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+WW91ciBvcmRlcjwvcD48aW1nIHNyYz0iY2lkOmxvZ28iPg==\r\n" +
+	"--rel\r\n" +
+	"Content-Type: image/png\r\n" +
+	"Content-ID: <logo>\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"iVBORw0KGgo=\r\n" +
+	"--rel--\r\n" +
+	"--alt--\r\n" +
+	"--outer\r\n" +
+	"Content-Disposition: attachment; filename=\"invoice.txt\"\r\n" +
+	"\r\n" +
+	"no content type here\r\n" +
+	"--outer--\r\n"
+
+func TestParse_Nested(t *testing.T) {
+	root, err := Parse([]byte(nestedMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := DecodeHeader(root.Header.Get("Subject")); got != "你好" {
+		t.Fatalf("subject: %q", got)
+	}
+	if got := root.Text(); got != "Your order is ready ✓" {
+		t.Fatalf("text: %q", got)
+	}
+	if got := root.HTML(); got != `<p>Your order</p><img src="cid:logo">` {
+		t.Fatalf("html: %q", got)
+	}
+	if p := root.FindContentID("logo"); p == nil || p.MediaType != "image/png" {
+		t.Fatalf("inline image: %+v", p)
+	}
+
+	attachments := root.Attachments()
+	if len(attachments) != 1 || attachments[0].Filename() != "invoice.txt" || attachments[0].MediaType != "text/plain" {
+		t.Fatalf("attachments: %+v", attachments)
+	}
+}
+
+func TestAttachments_ContentIDs(t *testing.T) {
+	raw := "Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+		"--b\r\nContent-Type: text/html\r\n\r\n<img src=\"cid:chart@x\">\r\n" +
+		"--b\r\nContent-Type: image/png\r\nContent-ID: <chart@x>\r\n\r\nPNG\r\n" +
+		"--b\r\nContent-Type: application/pdf; name=report.pdf\r\nContent-Disposition: inline\r\nContent-ID: <report@x>\r\n\r\n%PDF\r\n" +
+		"--b\r\nContent-Type: application/zip; name=a.zip\r\nContent-ID: <zip@x>\r\n\r\nPK\r\n" +
+		"--b--\r\n"
+	root, err := Parse([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, a := range root.Attachments() {
+		names = append(names, a.Filename())
+	}
+	// The referenced image belongs to the body; the rest are downloads.
+	if strings.Join(names, ",") != "report.pdf,a.zip" {
+		t.Fatalf("attachments: %v", names)
+	}
+}
+
+func TestParse_MissingBoundaryFallsBackToText(t *testing.T) {
+	raw := "Content-Type: multipart/mixed\r\n\r\nplain body\r\n"
+	root, err := Parse([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(root.Text(), "plain body") {
+		t.Fatalf("text: %q", root.Text())
+	}
+}
+
+func TestSnippet_StripsHTML(t *testing.T) {
+	raw := "Content-Type: text/html\r\n\r\n<html><head><style>p{}</style></head><body><p>Hi&nbsp;there</p>\r\n<p>Code: 1234</p></body></html>"
+	root, err := Parse([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := Snippet(root, 160); got != "Hi there Code: 1234" {
+		t.Fatalf("snippet: %q", got)
+	}
+}
+
+func TestParse_LegacyCharsets(t *testing.T) {
+	gbk, _ := simplifiedchinese.GBK.NewEncoder().String("验证码")
+	sjis, _ := japanese.ShiftJIS.NewEncoder().String("こんにちは")
+	jis, _ := japanese.ISO2022JP.NewEncoder().String("確認")
+	big5, _ := traditionalchinese.Big5.NewEncoder().String("郵件")
+
+	raw := "Subject: =?GB2312?B?" + base64.StdEncoding.EncodeToString([]byte(gbk)) + "?= =?ISO-2022-JP?B?" +
+		base64.StdEncoding.EncodeToString([]byte(jis)) + "?=\r\n" +
+		"Content-Type: multipart/alternative; boundary=b\r\n" +
+		"\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=gbk\r\n" +
+		"\r\n" + gbk + "\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/html; charset=\"Shift_JIS\"\r\n" +
+		"\r\n<p>" + sjis + "</p>\r\n" +
+		"--b\r\n" +
+		"Content-Type: text/plain; charset=big5; name=\"a.txt\"\r\n" +
+		"Content-Disposition: attachment\r\n" +
+		"\r\n" + big5 + "\r\n" +
+		"--b--\r\n"
+
+	root, err := Parse([]byte(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := DecodeHeader(root.Header.Get("Subject")); got != "验证码確認" {
+		t.Fatalf("subject: %q", got)
+	}
+	if got := root.Text(); got != "验证码" {
+		t.Fatalf("text: %q", got)
+	}
+	if got := root.HTML(); got != "<p>こんにちは</p>" {
+		t.Fatalf("html: %q", got)
+	}
+	att := root.Parts[2]
+	if got := att.DecodedText(); got != "郵件" {
+		t.Fatalf("big5: %q", got)
+	}
+	if string(att.Body) != big5 {
+		t.Fatal("attachment bytes must stay untouched")
+	}
+}
@@ -0,0 +1,86 @@
+package outbound
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"temp_mail/internal/mimeparse"
+	"temp_mail/internal/smtpclient"
+	"temp_mail/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// bounce stores a delivery status notification (RFC 3464) for the bounced
+// recipients of it in the sender's own mailbox.
+func (q *Queue) bounce(it *Item, raw []byte) {
+	if q.store == nil || !q.store.AddressExists(it.From) {
+		return
+	}
+	dsn := buildDSN(it, raw, time.Now())
+	msg := storage.Message{
+		From:    "Mail Delivery System <MAILER-DAEMON@" + smtpclient.ExtractDomain(it.From) + ">",
+		Subject: "Undelivered Mail Returned to Sender",
+		Raw:     dsn,
+	}
+	if root, err := mimeparse.Parse(dsn); err == nil {
+		msg.Snippet = mimeparse.Snippet(root, 160)
+	}
+	if _, err := q.store.Save(it.From, msg); err != nil {
+		log.Printf("outbound: %s: store bounce for %s: %v", it.ID, it.From, err)
+	}
+}
+
+func buildDSN(it *Item, raw []byte, now time.Time) []byte {
+	domain := smtpclient.ExtractDomain(it.From)
+	boundary := "dsn-" + uuid.NewString()
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", domain)
+	fmt.Fprintf(&b, "To: %s\r\n", it.From)
+	b.WriteString("Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", uuid.NewString(), domain)
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Your message %q (queue id %s) could not be delivered to:\r\n\r\n", it.Subject, it.ID)
+	for _, r := range it.Recipients {
+		if r.Status == StatusBounced {
+			fmt.Fprintf(&b, "  %s: %s\r\n", r.Address, oneLine(r.Error))
+		}
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\nArrival-Date: %s\r\n", domain, it.CreatedAt.Format(time.RFC1123Z))
+	for _, r := range it.Recipients {
+		if r.Status == StatusBounced {
+			fmt.Fprintf(&b, "\r\nFinal-Recipient: rfc822; %s\r\nAction: failed\r\nStatus: %s\r\nDiagnostic-Code: smtp; %s\r\n",
+				r.Address, dsnStatus(r.Error), oneLine(r.Error))
+		}
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i >= 0 {
+		b.Write(raw[:i+2])
+	}
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+	return b.Bytes()
+}
+
+// dsnStatus picks the status code for a diagnostic: 5.x.x for a permanent
+// reply, 4.4.7 (delivery time expired) when retries ran out.
+func dsnStatus(diag string) string {
+	if strings.HasPrefix(diag, "gave up") {
+		return "4.4.7"
+	}
+	return "5.0.0"
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
@@ -0,0 +1,498 @@
+// Package outbound queues mail sent through the API in a spool directory and
+// delivers it from background workers, retrying temporary failures with
+// exponential backoff and bouncing to the sender when delivery gives up.
+package outbound
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"temp_mail/internal/smtpclient"
+	"temp_mail/internal/storage"
+
+	"github.com/google/uuid"
+)
+
+// Item and recipient states.
+const (
+	StatusQueued   = "queued"   // waiting for the first attempt
+	StatusDeferred = "deferred" // a temporary failure, will retry
+	StatusSent     = "sent"
+	StatusBounced  = "bounced"
+	StatusPartial  = "partial" // finished, some recipients bounced
+)
+
+// Transport builds and delivers outbound mail. *smtpclient.Client
+// implements it. Deliver returns smtpclient.RcptErrors when only some
+// recipients were rejected; any other error applies to all of them.
+type Transport interface {
+	Build(msg smtpclient.Message) ([]byte, error)
+	Deliver(ctx context.Context, domain, from string, to []string, raw []byte) error
+}
+
+// Config tunes the queue. Zero values take the defaults of DefaultConfig.
+type Config struct {
+	// Dir is the spool directory; every item is <id>.eml plus <id>.json.
+	Dir     string
+	Workers int
+	// Lifetime is how long undelivered recipients are retried before they
+	// bounce.
+	Lifetime time.Duration
+	// Backoff is the first retry delay; it doubles per attempt up to
+	// MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Retain keeps finished items around for status queries.
+	Retain time.Duration
+}
+
+// DefaultConfig returns the defaults for a spool in dir.
+func DefaultConfig(dir string) Config {
+	return Config{
+		Dir:        dir,
+		Workers:    4,
+		Lifetime:   48 * time.Hour,
+		Backoff:    time.Minute,
+		MaxBackoff: time.Hour,
+		Retain:     24 * time.Hour,
+	}
+}
+
+// Recipient is the delivery state of one envelope recipient.
+type Recipient struct {
+	Address string `json:"address"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Item is one queued message.
+type Item struct {
+	ID          string      `json:"id"`
+	From        string      `json:"from"`
+	Subject     string      `json:"subject"`
+	Status      string      `json:"status"`
+	Recipients  []Recipient `json:"recipients"`
+	Attempts    int         `json:"attempts"`
+	CreatedAt   time.Time   `json:"createdAt"`
+	NextAttempt time.Time   `json:"nextAttempt"`
+	FinishedAt  time.Time   `json:"finishedAt"`
+}
+
+func (it *Item) pending() bool {
+	return it.Status == StatusQueued || it.Status == StatusDeferred
+}
+
+var (
+	// ErrNotFound is returned by Get for unknown or expired IDs.
+	ErrNotFound = errors.New("outbound: no such item")
+	// ErrBadRecipient is wrapped by Submit errors caused by invalid
+	// addresses; invalid headers wrap smtpclient.ErrBadHeader.
+	ErrBadRecipient = smtpclient.ErrBadAddress
+)
+
+// Queue is the outbound queue. It is safe for concurrent use.
+type Queue struct {
+	cfg   Config
+	tr    Transport
+	store storage.Store
+
+	mu       sync.Mutex
+	items    map[string]*Item
+	inflight map[string]bool
+
+	work chan string
+	wake chan struct{}
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	// ctx is cancelled by Close to abort in-flight deliveries.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// New opens the spool in cfg.Dir, reloading items left by a previous run,
+// and starts the workers. Bounces are stored in the sender's mailbox in
+// store.
+func New(cfg Config, tr Transport, store storage.Store) (*Queue, error) {
+	def := DefaultConfig(cfg.Dir)
+	if cfg.Workers <= 0 {
+		cfg.Workers = def.Workers
+	}
+	if cfg.Lifetime <= 0 {
+		cfg.Lifetime = def.Lifetime
+	}
+	if cfg.Backoff <= 0 {
+		cfg.Backoff = def.Backoff
+	}
+	if cfg.MaxBackoff < cfg.Backoff {
+		cfg.MaxBackoff = max(def.MaxBackoff, cfg.Backoff)
+	}
+	if cfg.Retain <= 0 {
+		cfg.Retain = def.Retain
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	q := &Queue{
+		cfg:      cfg,
+		tr:       tr,
+		store:    store,
+		items:    make(map[string]*Item),
+		inflight: make(map[string]bool),
+		work:     make(chan string),
+		wake:     make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	for i := 0; i < cfg.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	q.wg.Add(1)
+	go q.schedule()
+	return q, nil
+}
+
+// Submit builds msg, spools it and returns the queued item. Delivery happens
+// in the background.
+func (q *Queue) Submit(msg smtpclient.Message) (Item, error) {
+	rcpts, err := msg.Recipients()
+	if err != nil {
+		return Item{}, err
+	}
+	if len(rcpts) == 0 {
+		return Item{}, fmt.Errorf("%w: 收件人不能为空", ErrBadRecipient)
+	}
+	for _, to := range rcpts {
+		if smtpclient.ExtractDomain(to) == "" {
+			return Item{}, fmt.Errorf("%w: %s", ErrBadRecipient, to)
+		}
+	}
+	raw, err := q.tr.Build(msg)
+	if err != nil {
+		return Item{}, err
+	}
+	it := &Item{
+		ID:        uuid.NewString(),
+		From:      msg.From,
+		Subject:   msg.Subject,
+		Status:    StatusQueued,
+		CreatedAt: time.Now(),
+	}
+	it.NextAttempt = it.CreatedAt
+	for _, to := range rcpts {
+		it.Recipients = append(it.Recipients, Recipient{Address: to, Status: StatusQueued})
+	}
+	if err := writeFile(q.path(it.ID, ".eml"), raw); err != nil {
+		return Item{}, err
+	}
+	if err := q.save(it); err != nil {
+		_ = os.Remove(q.path(it.ID, ".eml"))
+		return Item{}, err
+	}
+	q.mu.Lock()
+	q.items[it.ID] = it
+	out := clone(it)
+	q.mu.Unlock()
+	q.kick()
+	return out, nil
+}
+
+// Get returns a snapshot of an item.
+func (q *Queue) Get(id string) (Item, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	it, ok := q.items[id]
+	if !ok {
+		return Item{}, ErrNotFound
+	}
+	return clone(it), nil
+}
+
+// Close aborts in-flight deliveries and stops the workers. Pending and
+// interrupted items stay in the spool for the next start.
+func (q *Queue) Close() error {
+	close(q.stop)
+	q.cancel()
+	q.wg.Wait()
+	return nil
+}
+
+func (q *Queue) kick() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// schedule hands due items to the workers and drops finished items once
+// they are past Retain.
+func (q *Queue) schedule() {
+	defer q.wg.Done()
+	defer close(q.work)
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		ids, next := q.due(time.Now())
+		for _, id := range ids {
+			select {
+			case q.work <- id:
+			case <-q.stop:
+				return
+			}
+		}
+		timer.Reset(time.Until(next))
+		select {
+		case <-q.stop:
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// due marks and returns the items whose next attempt has come, oldest first,
+// and removes expired finished items. next is when to look again.
+func (q *Queue) due(now time.Time) (ids []string, next time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	next = now.Add(time.Minute)
+	for id, it := range q.items {
+		switch {
+		case it.pending() && !q.inflight[id] && !now.Before(it.NextAttempt):
+			q.inflight[id] = true
+			ids = append(ids, id)
+		case it.pending() && !q.inflight[id]:
+			if it.NextAttempt.Before(next) {
+				next = it.NextAttempt
+			}
+		case !it.pending() && now.Sub(it.FinishedAt) > q.cfg.Retain:
+			delete(q.items, id)
+			_ = os.Remove(q.path(id, ".json"))
+			_ = os.Remove(q.path(id, ".eml"))
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return q.items[ids[i]].CreatedAt.Before(q.items[ids[j]].CreatedAt)
+	})
+	return ids, next
+}
+
+func (q *Queue) worker() {
+	defer q.wg.Done()
+	for id := range q.work {
+		q.attempt(id)
+		q.mu.Lock()
+		delete(q.inflight, id)
+		q.mu.Unlock()
+		q.kick()
+	}
+}
+
+// attempt tries every undelivered recipient of an item once, grouped by
+// domain, and reschedules or finishes it.
+func (q *Queue) attempt(id string) {
+	q.mu.Lock()
+	it := clone(q.items[id])
+	q.mu.Unlock()
+
+	raw, err := os.ReadFile(q.path(id, ".eml"))
+	if err != nil {
+		log.Printf("outbound: %s: read spool: %v", id, err)
+		for i := range it.Recipients {
+			if it.Recipients[i].Status != StatusSent {
+				it.Recipients[i].Status = StatusBounced
+				it.Recipients[i].Error = "spool file missing"
+			}
+		}
+		q.finish(&it, raw)
+		return
+	}
+
+	byDomain := make(map[string][]int)
+	for i, r := range it.Recipients {
+		if r.Status == StatusQueued || r.Status == StatusDeferred {
+			d := smtpclient.ExtractDomain(r.Address)
+			byDomain[d] = append(byDomain[d], i)
+		}
+	}
+	for domain, idx := range byDomain {
+		if q.ctx.Err() != nil {
+			break // shutting down; the rest waits for the next start
+		}
+		to := make([]string, len(idx))
+		for n, i := range idx {
+			to[n] = it.Recipients[i].Address
+		}
+		ctx, cancel := context.WithTimeout(q.ctx, 15*time.Minute)
+		err := q.tr.Deliver(ctx, domain, it.From, to, raw)
+		cancel()
+		var rcptErrs smtpclient.RcptErrors
+		isRcptErrs := errors.As(err, &rcptErrs)
+		for _, i := range idx {
+			r := &it.Recipients[i]
+			err := err
+			if isRcptErrs {
+				// Only the rejected recipients failed; the rest were delivered.
+				err = rcptErrs[r.Address]
+			}
+			switch {
+			case err == nil:
+				r.Status, r.Error = StatusSent, ""
+			case q.ctx.Err() != nil:
+				// Interrupted by Close, not refused by the receiver.
+				r.Status, r.Error = StatusDeferred, "delivery interrupted by shutdown"
+			case smtpclient.IsPermanent(err):
+				r.Status, r.Error = StatusBounced, err.Error()
+			default:
+				r.Status, r.Error = StatusDeferred, err.Error()
+			}
+		}
+		if err != nil {
+			log.Printf("outbound: %s: %s via %s: %v", id, it.From, domain, err)
+		}
+	}
+	now := time.Now()
+	if q.ctx.Err() != nil && hasStatus(it.Recipients, StatusDeferred, StatusQueued) {
+		// An interrupted attempt does not count; retry on the next start.
+		it.Status = StatusDeferred
+		it.NextAttempt = now
+		q.update(&it)
+		return
+	}
+	it.Attempts++
+
+	if !hasStatus(it.Recipients, StatusDeferred) {
+		q.finish(&it, raw)
+		return
+	}
+	if now.Sub(it.CreatedAt) >= q.cfg.Lifetime {
+		for i := range it.Recipients {
+			if r := &it.Recipients[i]; r.Status == StatusDeferred {
+				r.Status = StatusBounced
+				r.Error = fmt.Sprintf("gave up after %d attempts: %s", it.Attempts, r.Error)
+			}
+		}
+		q.finish(&it, raw)
+		return
+	}
+	it.Status = StatusDeferred
+	it.NextAttempt = now.Add(q.backoff(it.Attempts))
+	q.update(&it)
+}
+
+// backoff is the delay after the given number of failed attempts.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.cfg.Backoff
+	for i := 1; i < attempts && d < q.cfg.MaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, q.cfg.MaxBackoff)
+}
+
+// finish settles the overall status, bounces failed recipients to the sender
+// and persists the item.
+func (q *Queue) finish(it *Item, raw []byte) {
+	it.FinishedAt = time.Now()
+	it.NextAttempt = time.Time{}
+	switch {
+	case !hasStatus(it.Recipients, StatusBounced):
+		it.Status = StatusSent
+	case !hasStatus(it.Recipients, StatusSent):
+		it.Status = StatusBounced
+	default:
+		it.Status = StatusPartial
+	}
+	if it.Status != StatusSent {
+		q.bounce(it, raw)
+	}
+	q.update(it)
+	log.Printf("outbound: %s: %s after %d attempt(s)", it.ID, it.Status, it.Attempts)
+}
+
+func (q *Queue) update(it *Item) {
+	if err := q.save(it); err != nil {
+		log.Printf("outbound: %s: write spool: %v", it.ID, err)
+	}
+	q.mu.Lock()
+	q.items[it.ID] = it
+	q.mu.Unlock()
+}
+
+func (q *Queue) path(id, ext string) string {
+	return filepath.Join(q.cfg.Dir, id+ext)
+}
+
+func (q *Queue) save(it *Item) error {
+	data, err := json.MarshalIndent(it, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(q.path(it.ID, ".json"), data)
+}
+
+// load reads the spool. Items that were in flight when the process stopped
+// are retried right away.
+func (q *Queue) load() error {
+	entries, err := os.ReadDir(q.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || e.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(q.path(id, ".json"))
+		if err != nil {
+			return err
+		}
+		it := new(Item)
+		if err := json.Unmarshal(data, it); err != nil || it.ID != id {
+			log.Printf("outbound: skipping corrupt spool entry %s: %v", e.Name(), err)
+			continue
+		}
+		q.items[id] = it
+	}
+	if n := len(q.items); n > 0 {
+		log.Printf("outbound: loaded %d item(s) from %s", n, q.cfg.Dir)
+	}
+	return nil
+}
+
+// writeFile replaces path atomically.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func hasStatus(rs []Recipient, status ...string) bool {
+	for _, r := range rs {
+		if slices.Contains(status, r.Status) {
+			return true
+		}
+	}
+	return false
+}
+
+func clone(it *Item) Item {
+	out := *it
+	out.Recipients = append([]Recipient(nil), it.Recipients...)
+	return out
+}
@@ -0,0 +1,209 @@
+package outbound
+
+import (
+	"context"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"temp_mail/internal/smtpclient"
+	"temp_mail/internal/storage"
+)
+
+// fakeTransport fails each domain with the queued replies, then accepts.
+type fakeTransport struct {
+	mu      sync.Mutex
+	replies map[string][]error
+	calls   map[string]int
+}
+
+func (f *fakeTransport) Build(msg smtpclient.Message) ([]byte, error) {
+	return []byte("From: " + msg.From + "\r\nSubject: " + msg.Subject + "\r\n\r\n" + msg.Body + "\r\n"), nil
+}
+
+func (f *fakeTransport) Deliver(_ context.Context, domain, _ string, _ []string, _ []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[domain]++
+	if rs := f.replies[domain]; len(rs) > 0 {
+		f.replies[domain] = rs[1:]
+		return rs[0]
+	}
+	return nil
+}
+
+// hangTransport blocks every delivery until its context is cancelled.
+type hangTransport struct {
+	fakeTransport
+	started chan struct{}
+}
+
+func (h *hangTransport) Deliver(ctx context.Context, _, _ string, _ []string, _ []byte) error {
+	h.started <- struct{}{}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func waitDone(t *testing.T, q *Queue, id string) Item {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		it, err := q.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !it.pending() {
+			return it
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("item %s still pending", id)
+	return Item{}
+}
+
+func TestQueue_RetryAndBounce(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	store.CreateAddress("me@tmp.local")
+	tr := &fakeTransport{
+		replies: map[string][]error{
+			"grey.example": {&textproto.Error{Code: 451, Msg: "4.7.1 greylisted"}, &textproto.Error{Code: 451, Msg: "4.7.1 greylisted"}},
+			"perm.example": {&textproto.Error{Code: 550, Msg: "5.1.1 no such user"}},
+		},
+		calls: map[string]int{},
+	}
+	q, err := New(Config{Dir: t.TempDir(), Backoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}, tr, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Submit(smtpclient.Message{From: "me@tmp.local", To: []string{"a@grey.example", "b@perm.example"}, Subject: "hi", Body: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Status != StatusQueued || it.ID == "" {
+		t.Fatalf("submit returned %+v", it)
+	}
+	it = waitDone(t, q, it.ID)
+	if it.Status != StatusPartial || it.Recipients[0].Status != StatusSent || it.Recipients[1].Status != StatusBounced {
+		t.Fatalf("final state %+v", it)
+	}
+	if it.Attempts != 3 || tr.calls["perm.example"] != 1 {
+		t.Fatalf("attempts %d, perm calls %d", it.Attempts, tr.calls["perm.example"])
+	}
+	msgs := store.List("me@tmp.local")
+	if len(msgs) != 1 || msgs[0].Subject != "Undelivered Mail Returned to Sender" {
+		t.Fatalf("want one bounce in the sender mailbox, got %+v", msgs)
+	}
+	full, _ := store.Get("me@tmp.local", msgs[0].ID)
+	if raw := string(full.Raw); !strings.Contains(raw, "Final-Recipient: rfc822; b@perm.example") || strings.Contains(raw, "a@grey.example\r\nAction") {
+		t.Fatalf("bad DSN:\n%s", raw)
+	}
+}
+
+func TestQueue_RcptErrors(t *testing.T) {
+	tr := &fakeTransport{
+		replies: map[string][]error{"mixed.example": {
+			smtpclient.RcptErrors{"b@mixed.example": &textproto.Error{Code: 550, Msg: "5.1.1 no such user"}},
+		}},
+		calls: map[string]int{},
+	}
+	q, err := New(Config{Dir: t.TempDir(), Backoff: 10 * time.Millisecond}, tr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	it, err := q.Submit(smtpclient.Message{From: "me@tmp.local", To: []string{"a@mixed.example", "b@mixed.example"}, Subject: "s", Body: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	it = waitDone(t, q, it.ID)
+	a, b := it.Recipients[0], it.Recipients[1]
+	if it.Status != StatusPartial || a.Status != StatusSent || b.Status != StatusBounced || !strings.Contains(b.Error, "no such user") {
+		t.Fatalf("final state %+v", it)
+	}
+	if tr.calls["mixed.example"] != 1 {
+		t.Fatalf("delivered %d times", tr.calls["mixed.example"])
+	}
+}
+
+func TestQueue_LifetimeAndReload(t *testing.T) {
+	dir := t.TempDir()
+	down := &textproto.Error{Code: 421, Msg: "4.3.2 try later"}
+	tr := &fakeTransport{replies: map[string][]error{"slow.example": {down, down, down, down, down, down, down, down}}, calls: map[string]int{}}
+
+	// Stopped before the first retry is due: the item must survive a restart.
+	q, err := New(Config{Dir: dir, Backoff: time.Hour}, tr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := q.Submit(smtpclient.Message{From: "me@tmp.local", To: []string{"x@slow.example"}, Subject: "s", Body: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		if got, _ := q.Get(it.ID); got.Attempts == 1 || time.Now().After(deadline) {
+			break
+		}
+	}
+	q.Close()
+
+	q, err = New(Config{Dir: dir, Backoff: 5 * time.Millisecond, Lifetime: time.Nanosecond}, tr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	got, err := q.Get(it.ID)
+	if err != nil || got.Status != StatusDeferred || got.Attempts != 1 {
+		t.Fatalf("reloaded %+v, %v", got, err)
+	}
+	// Lifetime is long gone, but the item waits for its scheduled retry.
+	q.mu.Lock()
+	q.items[it.ID].NextAttempt = time.Now()
+	q.mu.Unlock()
+	q.kick()
+	got = waitDone(t, q, it.ID)
+	if got.Status != StatusBounced || !strings.HasPrefix(got.Recipients[0].Error, "gave up after 2 attempts") {
+		t.Fatalf("want bounce after lifetime, got %+v", got)
+	}
+	if _, err := q.Get("nope"); err != ErrNotFound {
+		t.Fatalf("unknown id: %v", err)
+	}
+}
+
+func TestQueue_CloseInterruptsDelivery(t *testing.T) {
+	dir := t.TempDir()
+	tr := &hangTransport{started: make(chan struct{}, 1)}
+	q, err := New(Config{Dir: dir, Workers: 1}, tr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := q.Submit(smtpclient.Message{From: "me@tmp.local", To: []string{"x@slow.example"}, Subject: "s", Body: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-tr.started
+	done := make(chan struct{})
+	go func() { q.Close(); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for the delivery")
+	}
+
+	// The interrupted attempt is kept for the next start and not counted.
+	ok := &fakeTransport{calls: map[string]int{}}
+	q, err = New(Config{Dir: dir}, ok, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	got := waitDone(t, q, it.ID)
+	if got.Status != StatusSent || got.Attempts != 1 {
+		t.Fatalf("after restart %+v", got)
+	}
+}
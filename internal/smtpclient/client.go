@@ -1,27 +1,50 @@
 package smtpclient
 
 import (
+	"context"
 	"crypto/tls"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"sort"
 	"strings"
 	"time"
 )
 
 // Message 邮件消息
 type Message struct {
-	From    string   // 发件人
-	To      []string // 收件人列表
-	Subject string   // 主题
-	Body    string   // 正文（纯文本）
-	HTML    string   // HTML正文（可选）
+	From        string            // 发件人
+	FromName    string            // 发件人显示名（可选）
+	To          []string          // 收件人列表，可带显示名，如 "张三 <a@example.com>"
+	Cc          []string          // 抄送（可选）
+	Bcc         []string          // 密送（可选），只出现在 SMTP 信封中，不写入邮件头
+	ReplyTo     []string          // Reply-To（可选）
+	InReplyTo   string            // 被回复邮件的 Message-ID（可选）
+	References  []string          // 会话中各邮件的 Message-ID（可选）
+	Headers     map[string]string // 自定义头（可选），名称必须以 X- 开头
+	Subject     string            // 主题
+	Body        string            // 正文（纯文本）
+	HTML        string            // HTML正文（可选）
+	Attachments []Attachment      // 附件与内嵌图片（可选）
+}
+
+const (
+	dialTimeout    = 30 * time.Second
+	sessionTimeout = 10 * time.Minute
+)
+
+// Signer 为外发邮件签名（如 DKIM），没有对应密钥时原样返回
+type Signer interface {
+	Sign(domain string, raw []byte) ([]byte, error)
 }
 
 // Client SMTP客户端
 type Client struct {
 	domain string // 本地域名
+	signer Signer // 可选的邮件签名器
+	relay  *Relay // 可选的中继，设置后不再直连 MX
 }
 
 // NewClient 创建SMTP客户端
@@ -29,89 +52,136 @@ func NewClient(domain string) *Client {
 	return &Client{domain: domain}
 }
 
-// Send 发送邮件（通过查找MX记录直接发送）
-func (c *Client) Send(msg Message) error {
-	// 验证发件人地址
+// SetSigner 设置外发邮件签名器，Build 按发件人域名签名
+func (c *Client) SetSigner(s Signer) {
+	c.signer = s
+}
+
+// Build 生成待投递的原始邮件，供发送队列写入 spool
+func (c *Client) Build(msg Message) ([]byte, error) {
 	if msg.From == "" {
-		return fmt.Errorf("发件人地址不能为空")
+		return nil, fmt.Errorf("发件人地址不能为空")
 	}
+	raw, err := c.buildMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	if c.signer == nil {
+		return raw, nil
+	}
+	return c.signer.Sign(ExtractDomain(msg.From), raw)
+}
 
-	// 构建邮件内容
-	body := c.buildMessage(msg)
+// Deliver 把 raw 投递给同一域名下的收件人：配置了中继时交给中继，
+// 否则按优先级依次尝试各个 MX。
+// 部分收件人被拒时返回 RcptErrors，其余收件人已投递成功；
+// 其他错误适用于全部收件人，可用 IsPermanent 判断是否值得重试。
+// ctx 到期时正在进行的连接会被中断，Deliver 返回后不会再有投递。
+func (c *Client) Deliver(ctx context.Context, domain, from string, to []string, raw []byte) error {
+	return c.deliver(ctx, domain, from, to, string(raw))
+}
 
-	// 按收件人域名分组发送
-	recipientsByDomain := make(map[string][]string)
-	for _, to := range msg.To {
-		domain := extractDomain(to)
-		if domain == "" {
-			return fmt.Errorf("无效的收件人地址: %s", to)
-		}
-		recipientsByDomain[domain] = append(recipientsByDomain[domain], to)
-	}
-
-	// 向每个域名发送邮件
-	var lastErr error
-	for domain, recipients := range recipientsByDomain {
-		if err := c.sendToDomain(domain, msg.From, recipients, body); err != nil {
-			// 简化错误提示
-			errMsg := strings.ToLower(err.Error())
-
-			// 检测常见的拒绝原因
-			if strings.Contains(errMsg, "not authorized") ||
-				strings.Contains(errMsg, "blocked") ||
-				strings.Contains(errMsg, "spamhaus") ||
-				strings.Contains(errMsg, "relay") {
-				// 国际邮箱拒绝
-				if domain == "gmail.com" || domain == "googlemail.com" {
-					lastErr = fmt.Errorf("Gmail 拒绝，建议用 QQ/163")
-				} else if domain == "outlook.com" || domain == "hotmail.com" || domain == "live.com" {
-					lastErr = fmt.Errorf("Outlook 拒绝，建议用 QQ/163")
-				} else {
-					lastErr = fmt.Errorf("对方拒绝接收（IP 被限制）")
-				}
-			} else if strings.Contains(errMsg, "连接失败") || strings.Contains(errMsg, "timeout") {
-				lastErr = fmt.Errorf("连接超时，请稍后重试")
-			} else if strings.Contains(errMsg, "无效") {
-				lastErr = fmt.Errorf("收件人地址无效")
-			} else {
-				// 其他错误，提供通用提示
-				lastErr = fmt.Errorf("发送失败，建议用 QQ/163")
-			}
-			// 继续尝试其他域名
+// IsPermanent 报告投递错误是否为 5xx 永久失败；连接失败、超时与 4xx 回复
+// （如灰名单）都视为临时错误
+func IsPermanent(err error) bool {
+	var te *textproto.Error
+	return errors.As(err, &te) && te.Code >= 500
+}
+
+// RcptErrors 按收件人记录 RCPT TO 被拒的原因；未列出的收件人已被对端接收
+type RcptErrors map[string]error
+
+func (e RcptErrors) Error() string {
+	rcpts := make([]string, 0, len(e))
+	for r := range e {
+		rcpts = append(rcpts, r)
+	}
+	sort.Strings(rcpts)
+	msgs := make([]string, len(rcpts))
+	for i, r := range rcpts {
+		msgs[i] = e[r].Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// permanent 报告是否所有被拒收件人都是 5xx 永久失败
+func (e RcptErrors) permanent() bool {
+	for _, err := range e {
+		if !IsPermanent(err) {
+			return false
 		}
 	}
+	return true
+}
 
-	return lastErr
+// isPermanent 与 IsPermanent 相同，但 RcptErrors 只在全部收件人
+// 都被永久拒绝时算作永久失败
+func isPermanent(err error) bool {
+	var rcptErrs RcptErrors
+	if errors.As(err, &rcptErrs) {
+		return rcptErrs.permanent()
+	}
+	return IsPermanent(err)
+}
+
+// ExtractDomain 返回收件地址的域名（小写），无效地址返回空串
+func ExtractDomain(email string) string {
+	return strings.ToLower(extractDomain(email))
 }
 
 // sendToDomain 向指定域名发送邮件
-func (c *Client) sendToDomain(domain string, from string, to []string, body string) error {
+func (c *Client) sendToDomain(ctx context.Context, domain string, from string, to []string, body string) error {
 	// 查找MX记录
-	mxRecords, err := net.LookupMX(domain)
+	mxRecords, err := net.DefaultResolver.LookupMX(ctx, domain)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err != nil || len(mxRecords) == 0 {
 		// 如果没有MX记录，尝试使用A记录
-		return c.sendToHost(domain+":25", from, to, body)
+		return c.sendToHost(ctx, domain+":25", from, to, body)
 	}
 
-	// 尝试每个MX记录（按优先级排序）
-	var lastErr error
+	// 尝试每个MX记录（按优先级排序）；任一 MX 给出临时错误时整体按临时错误处理，
+	// 只有全部 5xx 才算永久失败
+	var lastErr, tempErr error
 	for _, mx := range mxRecords {
+		if ctx.Err() != nil {
+			break
+		}
 		host := strings.TrimSuffix(mx.Host, ".")
-		if err := c.sendToHost(host+":25", from, to, body); err == nil {
+		err := c.sendToHost(ctx, host+":25", from, to, body)
+		if err == nil {
 			return nil
-		} else {
-			lastErr = err // 只保留最后一个错误
+		}
+		// 已有收件人收下了邮件，换 MX 重发会造成重复投递
+		var rcptErrs RcptErrors
+		if errors.As(err, &rcptErrs) && len(rcptErrs) < len(to) {
+			return err
+		}
+		lastErr = err // 只保留最后一个错误
+		if !isPermanent(err) {
+			tempErr = err
 		}
 	}
 
+	if tempErr != nil {
+		return tempErr
+	}
 	return lastErr
 }
 
 // sendToHost 向指定主机发送邮件
-func (c *Client) sendToHost(addr string, from string, to []string, body string) error {
-	// 连接到SMTP服务器
-	client, err := smtp.Dial(addr)
+func (c *Client) sendToHost(ctx context.Context, addr string, from string, to []string, body string) error {
+	// 连接到SMTP服务器；整个会话有超时，避免对端挂起时占住投递协程
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("连接失败 %s: %w", addr, err)
+	}
+	defer watchConn(ctx, conn)()
+	client, err := smtp.NewClient(conn, strings.Split(addr, ":")[0])
 	if err != nil {
+		conn.Close()
 		return fmt.Errorf("连接失败 %s: %w", addr, err)
 	}
 	defer client.Close()
@@ -133,18 +203,40 @@ func (c *Client) sendToHost(addr string, from string, to []string, body string)
 			// log.Printf("STARTTLS 失败，继续使用明文: %v", err)
 		}
 	}
+	return transact(client, from, to, body)
+}
+
+// watchConn 给连接设置会话超时（不晚于 ctx 的截止时间），并在 ctx 取消时
+// 立即中断连接上的读写；返回的函数停止监听
+func watchConn(ctx context.Context, conn net.Conn) (stop func() bool) {
+	deadline := time.Now().Add(sessionTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetDeadline(deadline)
+	return context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+}
 
+// transact 在已握手的连接上提交一封邮件并退出。
+// 某个 RCPT TO 被拒后继续提交其余收件人，邮件只投给被接收的收件人，
+// 被拒的收件人以 RcptErrors 返回。
+func transact(client *smtp.Client, from string, to []string, body string) error {
 	// 设置发件人
-	if err = client.Mail(from); err != nil {
+	if err := client.Mail(from); err != nil {
 		return fmt.Errorf("MAIL FROM失败 (from=%s): %w", from, err)
 	}
 
 	// 设置收件人
+	rejected := RcptErrors{}
 	for _, recipient := range to {
-		if err = client.Rcpt(recipient); err != nil {
-			return fmt.Errorf("RCPT TO失败 (to=%s): %w", recipient, err)
+		if err := client.Rcpt(recipient); err != nil {
+			rejected[recipient] = fmt.Errorf("RCPT TO失败 (to=%s): %w", recipient, err)
 		}
 	}
+	if len(rejected) == len(to) {
+		_ = client.Quit()
+		return rejected
+	}
 
 	// 发送邮件内容
 	w, err := client.Data()
@@ -162,8 +254,12 @@ func (c *Client) sendToHost(addr string, from string, to []string, body string)
 		return fmt.Errorf("关闭DATA失败: %w", err)
 	}
 
-	// 退出
-	return client.Quit()
+	// 对端已接收邮件，QUIT 失败不影响投递结果
+	_ = client.Quit()
+	if len(rejected) > 0 {
+		return rejected
+	}
+	return nil
 }
 
 // extractDomain 从邮件地址中提取域名
@@ -174,70 +270,3 @@ func extractDomain(email string) string {
 	} 
 	return parts[1]
 }
-
-// buildMessage 构建邮件内容
-func (c *Client) buildMessage(msg Message) string {
-	var sb strings.Builder
-
-	// 邮件头
-	sb.WriteString(fmt.Sprintf("From: %s\r\n", msg.From))
-	sb.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(msg.To, ", ")))
-	sb.WriteString(fmt.Sprintf("Subject: %s\r\n", encodeSubject(msg.Subject)))
-	sb.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
-	sb.WriteString("MIME-Version: 1.0\r\n")
-
-	// 如果有HTML内容，使用multipart
-	if msg.HTML != "" {
-		boundary := fmt.Sprintf("boundary_%d", time.Now().Unix())
-		sb.WriteString(fmt.Sprintf("Content-Type: multipart/alternative; boundary=\"%s\"\r\n", boundary))
-		sb.WriteString("\r\n")
-
-		// 纯文本部分
-		if msg.Body != "" {
-			sb.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-			sb.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
-			sb.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
-			sb.WriteString("\r\n")
-			sb.WriteString(msg.Body)
-			sb.WriteString("\r\n")
-		}
-
-		// HTML部分
-		sb.WriteString(fmt.Sprintf("--%s\r\n", boundary))
-		sb.WriteString("Content-Type: text/html; charset=UTF-8\r\n")
-		sb.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
-		sb.WriteString("\r\n")
-		sb.WriteString(msg.HTML)
-		sb.WriteString("\r\n")
-
-		sb.WriteString(fmt.Sprintf("--%s--\r\n", boundary))
-	} else {
-		// 只有纯文本
-		sb.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
-		sb.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
-		sb.WriteString("\r\n")
-		sb.WriteString(msg.Body)
-	}
-
-	return sb.String()
-}
-
-// encodeSubject 编码邮件主题（支持中文）
-func encodeSubject(subject string) string {
-	// 检查是否包含非ASCII字符
-	needEncode := false
-	for _, r := range subject {
-		if r > 127 {
-			needEncode = true
-			break
-		}
-	}
-
-	if !needEncode {
-		return subject
-	}
-
-	// 使用Base64编码
-	encoded := base64.StdEncoding.EncodeToString([]byte(subject))
-	return fmt.Sprintf("=?UTF-8?B?%s?=", encoded)
-}
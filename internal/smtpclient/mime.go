@@ -0,0 +1,314 @@
+package smtpclient
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrBadAddress 包装由无效地址引起的构建错误
+	ErrBadAddress = errors.New("无效的收件人地址")
+	// ErrBadHeader 包装由无效的自定义头、In-Reply-To 或 References 引起的构建错误
+	ErrBadHeader = errors.New("无效的邮件头")
+)
+
+var (
+	// customHeaderRe 匹配允许的自定义头名称
+	customHeaderRe = regexp.MustCompile(`^(?i)x-[a-z0-9]+(-[a-z0-9]+)*$`)
+	// msgIDRe 匹配 RFC 5322 msg-id（两侧均为 dot-atom-text），尖括号可省略
+	msgIDRe = regexp.MustCompile("^<?" + dotAtom + "@" + dotAtom + ">?$")
+)
+
+// dotAtom 匹配 RFC 5322 的 dot-atom-text
+const dotAtom = "[A-Za-z0-9!#$%&'*+/=?^_`{|}~-]+(\\.[A-Za-z0-9!#$%&'*+/=?^_`{|}~-]+)*"
+
+// maxHeaderLine 是单行邮件头的上限（RFC 5322 为 998 字节）
+const maxHeaderLine = 998
+
+// Attachment 附件；ContentID 非空时作为 HTML 正文的内嵌资源
+// （multipart/related），正文中以 cid:<ContentID> 引用
+type Attachment struct {
+	Filename    string
+	ContentType string // 为空时按扩展名推断，推断不出时为 application/octet-stream
+	ContentID   string
+	Data        []byte
+}
+
+// Recipients 返回 To、Cc 与 Bcc 中各地址去掉显示名后的邮箱（去重），
+// 作为 SMTP 信封收件人
+func (m Message) Recipients() ([]string, error) {
+	var out []string
+	seen := make(map[string]bool)
+	for _, list := range [][]string{m.To, m.Cc, m.Bcc} {
+		addrs, err := parseAddresses(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range addrs {
+			if key := strings.ToLower(a.Address); !seen[key] {
+				seen[key] = true
+				out = append(out, a.Address)
+			}
+		}
+	}
+	return out, nil
+}
+
+// Validate 检查地址与各邮件头，错误包装 ErrBadAddress 或 ErrBadHeader
+func (m Message) Validate() error {
+	if _, err := m.Recipients(); err != nil {
+		return err
+	}
+	if _, err := parseAddresses(m.ReplyTo); err != nil {
+		return err
+	}
+	for _, id := range append([]string{m.InReplyTo}, m.References...) {
+		if id != "" && !msgIDRe.MatchString(id) {
+			return fmt.Errorf("%w: Message-ID %q", ErrBadHeader, id)
+		}
+	}
+	for i, a := range m.Attachments {
+		if a.ContentType != "" {
+			if _, _, err := mime.ParseMediaType(a.ContentType); err != nil {
+				return fmt.Errorf("%w: 附件 %d 的 Content-Type %q", ErrBadHeader, i, a.ContentType)
+			}
+		}
+		if a.ContentID != "" && !msgIDRe.MatchString(a.ContentID) {
+			return fmt.Errorf("%w: 附件 %d 的 Content-ID %q 须为 id@host 形式", ErrBadHeader, i, a.ContentID)
+		}
+	}
+	seen := make(map[string]string, len(m.Headers))
+	for name, value := range m.Headers {
+		if !customHeaderRe.MatchString(name) {
+			return fmt.Errorf("%w: 自定义头 %q 的名称必须以 X- 开头且只含字母、数字和连字符", ErrBadHeader, name)
+		}
+		// 名称写入时会规范化大小写，X-Run 与 x-run 会成为两个同名头
+		key := textproto.CanonicalMIMEHeaderKey(name)
+		if prev, dup := seen[key]; dup {
+			return fmt.Errorf("%w: 自定义头 %q 与 %q 重复", ErrBadHeader, prev, name)
+		}
+		seen[key] = name
+		if strings.IndexFunc(value, func(r rune) bool { return (r < ' ' && r != '\t') || r == 0x7f }) >= 0 {
+			return fmt.Errorf("%w: 自定义头 %s 的值不能包含换行或控制字符", ErrBadHeader, name)
+		}
+		if len(name)+2+len(mime.BEncoding.Encode("UTF-8", value)) > maxHeaderLine {
+			return fmt.Errorf("%w: 自定义头 %s 过长", ErrBadHeader, name)
+		}
+	}
+	return nil
+}
+
+// parseAddresses 解析地址列表，每项可带显示名
+func parseAddresses(list []string) ([]*mail.Address, error) {
+	out := make([]*mail.Address, 0, len(list))
+	for _, s := range list {
+		a, err := mail.ParseAddress(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadAddress, s)
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// formatAddresses 把地址列表格式化为邮件头的值，显示名按 RFC 2047 编码
+func formatAddresses(list []*mail.Address) string {
+	out := make([]string, len(list))
+	for i, a := range list {
+		out[i] = a.String()
+	}
+	return strings.Join(out, ", ")
+}
+
+// formatMsgID 补全 Message-ID 的尖括号
+func formatMsgID(id string) string {
+	return "<" + strings.Trim(id, "<>") + ">"
+}
+
+// mimePart 是一个已编码的 MIME 分段
+type mimePart struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// buildMessage 构建邮件：文本与 HTML 组成 multipart/alternative，内嵌图片与
+// HTML 组成 multipart/related，其余附件与正文组成 multipart/mixed。
+// Bcc 不写入邮件头。
+func (c *Client) buildMessage(msg Message) ([]byte, error) {
+	if err := msg.Validate(); err != nil {
+		return nil, err
+	}
+	from := mail.Address{Name: msg.FromName, Address: msg.From}
+	// 地址已在 Validate 中校验
+	to, _ := parseAddresses(msg.To)
+	cc, _ := parseAddresses(msg.Cc)
+	replyTo, _ := parseAddresses(msg.ReplyTo)
+
+	var inline, attached []mimePart
+	for _, a := range msg.Attachments {
+		if a.ContentID != "" && msg.HTML != "" {
+			inline = append(inline, attachmentPart(a, "inline"))
+		} else {
+			attached = append(attached, attachmentPart(a, "attachment"))
+		}
+	}
+
+	var root mimePart
+	var err error
+	switch {
+	case msg.HTML == "":
+		root = textPart("text/plain", msg.Body)
+	default:
+		html := textPart("text/html", msg.HTML)
+		if len(inline) > 0 {
+			if html, err = multipartOf("related", append([]mimePart{html}, inline...)); err != nil {
+				return nil, err
+			}
+		}
+		root = html
+		if msg.Body != "" {
+			if root, err = multipartOf("alternative", []mimePart{textPart("text/plain", msg.Body), html}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(attached) > 0 {
+		if root, err = multipartOf("mixed", append([]mimePart{root}, attached...)); err != nil {
+			return nil, err
+		}
+	}
+
+	domain := ExtractDomain(msg.From)
+	if domain == "" {
+		domain = c.domain
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from.String())
+	if len(to) > 0 {
+		fmt.Fprintf(&b, "To: %s\r\n", formatAddresses(to))
+	} else {
+		// 只有 Cc/Bcc 时写入空组，避免部分 MTA 按信封补出 To 头而暴露密送地址
+		b.WriteString("To: undisclosed-recipients:;\r\n")
+	}
+	if len(cc) > 0 {
+		fmt.Fprintf(&b, "Cc: %s\r\n", formatAddresses(cc))
+	}
+	if len(replyTo) > 0 {
+		fmt.Fprintf(&b, "Reply-To: %s\r\n", formatAddresses(replyTo))
+	}
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.BEncoding.Encode("UTF-8", msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", uuid.NewString(), domain)
+	if msg.InReplyTo != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", formatMsgID(msg.InReplyTo))
+	}
+	if len(msg.References) > 0 {
+		refs := make([]string, len(msg.References))
+		for i, id := range msg.References {
+			refs[i] = formatMsgID(id)
+		}
+		// 每个 Message-ID 单独一行折叠，避免超过行长上限
+		fmt.Fprintf(&b, "References: %s\r\n", strings.Join(refs, "\r\n "))
+	}
+	names := make([]string, 0, len(msg.Headers))
+	for name := range msg.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\r\n", textproto.CanonicalMIMEHeaderKey(name), mime.BEncoding.Encode("UTF-8", msg.Headers[name]))
+	}
+	b.WriteString("MIME-Version: 1.0\r\n")
+	writeHeader(&b, root.header)
+	b.WriteString("\r\n")
+	b.Write(root.body)
+	return b.Bytes(), nil
+}
+
+// textPart 以 quoted-printable 编码文本正文，换行统一为 CRLF
+func textPart(contentType, text string) mimePart {
+	var body bytes.Buffer
+	qp := quotedprintable.NewWriter(&body)
+	qp.Write([]byte(text))
+	qp.Close()
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=UTF-8")
+	h.Set("Content-Transfer-Encoding", "quoted-printable")
+	return mimePart{header: h, body: body.Bytes()}
+}
+
+// attachmentPart 以 base64（每行 76 字符）编码附件，文件名按 RFC 2231 编码。
+// Content-Type 解析后重新生成，ContentType 与 ContentID 已由 Validate 校验。
+func attachmentPart(a Attachment, disposition string) mimePart {
+	ct := a.ContentType
+	if ct == "" {
+		ct = mime.TypeByExtension(strings.ToLower(filepath.Ext(a.Filename)))
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if ct = mime.FormatMediaType(mt, params); err != nil || ct == "" {
+		ct = "application/octet-stream"
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", ct)
+	h.Set("Content-Transfer-Encoding", "base64")
+	if a.Filename != "" {
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.Filename}))
+	} else {
+		h.Set("Content-Disposition", disposition)
+	}
+	if disposition == "inline" {
+		h.Set("Content-ID", formatMsgID(a.ContentID))
+	}
+
+	enc := base64.StdEncoding.EncodeToString(a.Data)
+	var body bytes.Buffer
+	for len(enc) > 76 {
+		body.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	body.WriteString(enc + "\r\n")
+	return mimePart{header: h, body: body.Bytes()}
+}
+
+// multipartOf 把若干分段组合为 multipart/<subtype>，boundary 随机生成
+func multipartOf(subtype string, parts []mimePart) (mimePart, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		w, err := mw.CreatePart(p.header)
+		if err != nil {
+			return mimePart{}, err
+		}
+		if _, err := w.Write(p.body); err != nil {
+			return mimePart{}, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return mimePart{}, err
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": mw.Boundary()}))
+	return mimePart{header: h, body: body.Bytes()}, nil
+}
+
+func writeHeader(b *bytes.Buffer, h textproto.MIMEHeader) {
+	for _, k := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-ID"} {
+		if v := h.Get(k); v != "" {
+			fmt.Fprintf(b, "%s: %s\r\n", k, v)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package smtpclient
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"temp_mail/internal/mimeparse"
+)
+
+func TestBuild_MIME(t *testing.T) {
+	c := NewClient("tmp.local")
+	png := []byte("\x89PNG\r\n\x1a\n" + strings.Repeat("\x00\xff", 100))
+	text := "第一行 " + strings.Repeat("long line ", 20) + "\nsecond = line\n"
+	msg := Message{
+		From:     "me@tmp.local",
+		FromName: "测试 Sender",
+		To:       []string{"张三 <zhang@example.com>", "bob@example.org"},
+		Subject:  "你好, world",
+		Body:     text,
+		HTML:     `<p>hi <img src="cid:logo@tmp.local"></p>`,
+		Attachments: []Attachment{
+			{Filename: "logo.png", ContentID: "logo@tmp.local", Data: png},
+			{Filename: "报告.pdf", Data: []byte("%PDF-1.4")},
+		},
+	}
+	raw, err := c.Build(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 998 || strings.ContainsAny(line, "\n") {
+			t.Fatalf("bad line %q", line)
+		}
+		for _, r := range line {
+			if r > 127 {
+				t.Fatalf("non-ASCII in %q", line)
+			}
+		}
+	}
+
+	root, err := mimeparse.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := root.Header
+	if got := mimeparse.DecodeHeader(h.Get("From")); got != "测试 Sender <me@tmp.local>" {
+		t.Errorf("From %q", got)
+	}
+	if got := mimeparse.DecodeHeader(h.Get("To")); !strings.Contains(got, "张三") || !strings.Contains(got, "<zhang@example.com>") {
+		t.Errorf("To %q", got)
+	}
+	if got := mimeparse.DecodeHeader(h.Get("Subject")); got != msg.Subject {
+		t.Errorf("Subject %q", got)
+	}
+	if id := h.Get("Message-Id"); !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, "@tmp.local>") {
+		t.Errorf("Message-ID %q", id)
+	}
+
+	// mixed{alternative{text, related{html, logo}}, pdf}
+	if root.MediaType != "multipart/mixed" || len(root.Parts) != 2 {
+		t.Fatalf("root %s with %d parts", root.MediaType, len(root.Parts))
+	}
+	alt := root.Parts[0]
+	if alt.MediaType != "multipart/alternative" || alt.Parts[1].MediaType != "multipart/related" {
+		t.Fatalf("body structure %s / %s", alt.MediaType, alt.Parts[1].MediaType)
+	}
+	if got := root.Text(); got != strings.ReplaceAll(text, "\n", "\r\n") {
+		t.Errorf("text %q", got)
+	}
+	logo := root.FindContentID("logo@tmp.local")
+	if logo == nil || !bytes.Equal(logo.Body, png) || logo.MediaType != "image/png" || logo.Disposition != "inline" {
+		t.Fatalf("inline image %+v", logo)
+	}
+	atts := root.Attachments()
+	if len(atts) != 1 || atts[0].Filename() != "报告.pdf" || atts[0].MediaType != "application/pdf" || string(atts[0].Body) != "%PDF-1.4" {
+		t.Fatalf("attachments %+v", atts)
+	}
+
+	// Boundaries and Message-IDs differ between messages.
+	again, _ := c.Build(msg)
+	if alt.Params["boundary"] == "" || bytes.Contains(again, []byte(alt.Params["boundary"])) {
+		t.Error("boundary reused")
+	}
+	if bytes.Contains(again, []byte(h.Get("Message-Id"))) {
+		t.Error("Message-ID reused")
+	}
+}
+
+func TestBuild_BadAddress(t *testing.T) {
+	_, err := NewClient("tmp.local").Build(Message{From: "me@tmp.local", To: []string{"not an address"}})
+	if !errors.Is(err, ErrBadAddress) {
+		t.Fatalf("got %v", err)
+	}
+}
+
+func TestBuild_Headers(t *testing.T) {
+	msg := Message{
+		From:       "me@tmp.local",
+		Cc:         []string{"Carol <carol@example.com>"},
+		Bcc:        []string{"hidden@example.net", "CAROL@example.com"},
+		ReplyTo:    []string{"list@example.com"},
+		InReplyTo:  "orig@example.com",
+		References: []string{"<root@example.com>", "orig@example.com"},
+		Headers:    map[string]string{"x-test-id": "42", "X-Note": "测试"},
+		Subject:    "re",
+		Body:       "b",
+	}
+	rcpts, err := msg.Recipients()
+	if err != nil || strings.Join(rcpts, ",") != "carol@example.com,hidden@example.net" {
+		t.Fatalf("recipients %v %v", rcpts, err)
+	}
+	raw, err := NewClient("tmp.local").Build(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(bytes.ToLower(raw), []byte("hidden")) || bytes.Contains(raw, []byte("Bcc")) {
+		t.Fatalf("Bcc leaked into headers:\n%s", raw)
+	}
+	root, err := mimeparse.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := root.Header
+	for k, want := range map[string]string{
+		"To":          "undisclosed-recipients:;",
+		"Cc":          `"Carol" <carol@example.com>`,
+		"Reply-To":    "<list@example.com>",
+		"In-Reply-To": "<orig@example.com>",
+		"References":  "<root@example.com> <orig@example.com>",
+		"X-Test-Id":   "42",
+	} {
+		if got := h.Get(k); got != want {
+			t.Errorf("%s: got %q, want %q", k, got, want)
+		}
+	}
+	if got := mimeparse.DecodeHeader(h.Get("X-Note")); got != "测试" {
+		t.Errorf("X-Note %q", got)
+	}
+
+	for _, bad := range []Message{
+		{Headers: map[string]string{"Subject": "x"}},
+		{Headers: map[string]string{"X-Bad Name": "x"}},
+		{Headers: map[string]string{"X-Run": "1", "x-run": "2"}},
+		{Headers: map[string]string{"X-Inject": "x\r\nBcc: evil@example.com"}},
+		{Headers: map[string]string{"X-Long": strings.Repeat("a", 1000)}},
+		{InReplyTo: "no-at-sign"},
+		{References: []string{"<a@b> <c@d>"}},
+		{Attachments: []Attachment{{ContentType: "text/plain\r\nBcc: x@evil.example"}}},
+		{Attachments: []Attachment{{ContentID: "a@b>\r\nBcc: x@evil.example"}}},
+		{Attachments: []Attachment{{ContentID: "logo"}}},
+	} {
+		bad.From, bad.To = "me@tmp.local", []string{"you@example.com"}
+		if err := bad.Validate(); !errors.Is(err, ErrBadHeader) {
+			t.Errorf("%+v: got %v", bad, err)
+		}
+	}
+	// Attachment types are re-serialised rather than copied.
+	raw, err = NewClient("tmp.local").Build(Message{From: "me@tmp.local", To: []string{"a@example.com"},
+		Attachments: []Attachment{{Filename: "a.txt", ContentType: `Text/Plain; charset="utf-8"`, Data: []byte("x")}}})
+	if err != nil || !bytes.Contains(raw, []byte("Content-Type: text/plain; charset=utf-8\r\n")) {
+		t.Errorf("attachment type: %v\n%s", err, raw)
+	}
+	if err := (Message{ReplyTo: []string{"nope"}}).Validate(); !errors.Is(err, ErrBadAddress) {
+		t.Errorf("bad Reply-To: got %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package smtpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"slices"
+	"strings"
+)
+
+// 中继连接的加密方式
+const (
+	RelaySTARTTLS = "starttls" // 明文连接后必须升级到 TLS（默认，常见于 587 端口）
+	RelayTLS      = "tls"      // 隐式 TLS（常见于 465 端口）
+	RelayNone     = "none"     // 不加密，仅适合本机或内网中继
+)
+
+// Relay 中继（smarthost）配置：所有外发邮件经由该主机投递，而不是直连收件域 MX
+type Relay struct {
+	Addr     string // host:port
+	Username string // 为空时不做 SMTP AUTH
+	Password string
+	// Auth 为认证机制：plain、login 或 cram-md5；为空时从服务器 EHLO
+	// 公布的机制中选择
+	Auth string
+	// Security 为 RelaySTARTTLS、RelayTLS 或 RelayNone，空值视为 RelaySTARTTLS
+	Security string
+	// TLSConfig 可选，用于自定义根证书等；ServerName 默认取 Addr 的主机名
+	TLSConfig *tls.Config
+	// Fallback 为 true 时，中继临时失败（连接不上、4xx）后改为直连 MX 投递
+	Fallback bool
+}
+
+// SetRelay 设置中继，传 nil 恢复直连 MX
+func (c *Client) SetRelay(r *Relay) {
+	c.relay = r
+}
+
+// deliver 按配置选择中继或直连 MX
+func (c *Client) deliver(ctx context.Context, domain, from string, to []string, body string) error {
+	if c.relay == nil {
+		return c.sendToDomain(ctx, domain, from, to, body)
+	}
+	err := c.sendViaRelay(ctx, from, to, body)
+	var rcptErrs RcptErrors
+	if errors.As(err, &rcptErrs) {
+		// 逐个收件人的结果原样交给队列；中继已接收部分收件人时不能再直连重发
+		return err
+	}
+	if err != nil && c.relay.Fallback && !IsPermanent(err) && ctx.Err() == nil {
+		if direct := c.sendToDomain(ctx, domain, from, to, body); direct != nil {
+			return fmt.Errorf("%v；直连 MX 也失败: %w", err, direct)
+		}
+		return nil
+	}
+	return err
+}
+
+// sendViaRelay 通过中继发送：按配置建立 TLS、认证，然后提交邮件
+func (c *Client) sendViaRelay(ctx context.Context, from string, to []string, body string) error {
+	r := c.relay
+	host, _, err := net.SplitHostPort(r.Addr)
+	if err != nil {
+		return fmt.Errorf("无效的中继地址 %s: %v", r.Addr, err)
+	}
+	tlsConfig := &tls.Config{}
+	if r.TLSConfig != nil {
+		tlsConfig = r.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	var conn net.Conn
+	if r.Security == RelayTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", r.Addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", r.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("连接中继失败 %s: %w", r.Addr, err)
+	}
+	defer watchConn(ctx, conn)()
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("连接中继失败 %s: %w", r.Addr, err)
+	}
+	defer client.Close()
+
+	if err = client.Hello(c.domain); err != nil {
+		return fmt.Errorf("HELO失败 (domain=%s): %w", c.domain, err)
+	}
+	if r.Security == "" || r.Security == RelaySTARTTLS {
+		// 不允许降级为明文，否则口令会被窃听
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("中继 %s 不支持 STARTTLS", r.Addr)
+		}
+		if err = client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("中继 STARTTLS 失败 %s: %w", r.Addr, err)
+		}
+	}
+
+	if r.Username != "" {
+		auth, err := relayAuth(client, r, host)
+		if err != nil {
+			return err
+		}
+		// 认证失败多是配置问题，按临时错误处理（不 %w 原始 5xx 回复），
+		// 修正配置后队列里的邮件仍可重试，而不是全部退信
+		if err = client.Auth(auth); err != nil {
+			return fmt.Errorf("中继认证失败 (user=%s): %v", r.Username, err)
+		}
+	}
+	return transact(client, from, to, body)
+}
+
+// relayAuth 返回配置的认证机制；未指定时从服务器公布的机制中挑选，
+// 未加密的连接优先用不传输明文口令的 CRAM-MD5，PLAIN 与 LOGIN 在未加密
+// 连接上只用于本机中继
+func relayAuth(client *smtp.Client, r *Relay, host string) (smtp.Auth, error) {
+	mech := strings.ToLower(r.Auth)
+	if mech == "" {
+		ok, advertised := client.Extension("AUTH")
+		if !ok {
+			return nil, fmt.Errorf("中继 %s 不支持 AUTH", r.Addr)
+		}
+		offered := strings.Fields(strings.ToLower(advertised))
+		prefer := []string{"plain", "login", "cram-md5"}
+		if r.Security == RelayNone {
+			prefer = []string{"cram-md5", "plain", "login"}
+		}
+		for _, m := range prefer {
+			if slices.Contains(offered, m) {
+				mech = m
+				break
+			}
+		}
+		if mech == "" {
+			return nil, fmt.Errorf("中继 %s 不支持 PLAIN/LOGIN/CRAM-MD5 认证 (offered: %s)", r.Addr, advertised)
+		}
+	}
+	switch mech {
+	case "plain":
+		return smtp.PlainAuth("", r.Username, r.Password, host), nil
+	case "login":
+		return &loginAuth{username: r.Username, password: r.Password, host: host}, nil
+	case "cram-md5":
+		return smtp.CRAMMD5Auth(r.Username, r.Password), nil
+	}
+	return nil, fmt.Errorf("不支持的认证机制: %s", r.Auth)
+}
+
+// loginAuth 实现 net/smtp 未提供的 AUTH LOGIN。与 smtp.PlainAuth 一样，
+// 只在 TLS 连接或本机中继上发送口令
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	prompt := strings.ToLower(string(fromServer))
+	switch {
+	case strings.HasPrefix(prompt, "user"):
+		return []byte(a.username), nil
+	case strings.HasPrefix(prompt, "pass"):
+		return []byte(a.password), nil
+	}
+	return nil, errors.New("unexpected AUTH LOGIN challenge: " + string(fromServer))
+}
@@ -0,0 +1,279 @@
+package smtpclient
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	netsmtp "net/smtp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"temp_mail/internal/smtpserver"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// relayServer is a local go-smtp stand-in for a smarthost that accepts
+// user/secret over PLAIN, LOGIN and CRAM-MD5.
+type relayServer struct {
+	mu    sync.Mutex
+	mails []relayedMail
+}
+
+type relayedMail struct {
+	user, from string
+	to         []string
+	body       string
+}
+
+func (b *relayServer) NewSession(*smtp.Conn) (smtp.Session, error) {
+	return &relaySession{srv: b}, nil
+}
+
+type relaySession struct {
+	srv  *relayServer
+	user string
+	mail relayedMail
+}
+
+func (s *relaySession) login(user, pass string) error {
+	if user != "user" || pass != "secret" {
+		return smtp.ErrAuthFailed
+	}
+	s.user = user
+	return nil
+}
+
+func (s *relaySession) AuthPlain(user, pass string) error { return s.login(user, pass) }
+
+func (s *relaySession) Mail(from string, _ *smtp.MailOptions) error {
+	if s.user == "" {
+		return smtp.ErrAuthRequired
+	}
+	s.mail = relayedMail{user: s.user, from: from}
+	return nil
+}
+
+func (s *relaySession) Rcpt(to string, _ *smtp.RcptOptions) error {
+	switch {
+	case strings.HasPrefix(to, "nobody@"):
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+	case strings.HasPrefix(to, "grey@"):
+		return &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "greylisted"}
+	}
+	s.mail.to = append(s.mail.to, to)
+	return nil
+}
+
+func (s *relaySession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.mail.body = string(b)
+	s.srv.mu.Lock()
+	s.srv.mails = append(s.srv.mails, s.mail)
+	s.srv.mu.Unlock()
+	return nil
+}
+
+func (s *relaySession) Reset()        {}
+func (s *relaySession) Logout() error { return nil }
+
+// cramMD5Server is the server side of CRAM-MD5 (RFC 2195).
+type cramMD5Server struct {
+	sess      *relaySession
+	challenge string
+}
+
+func (c *cramMD5Server) Next(resp []byte) ([]byte, bool, error) {
+	if c.challenge == "" {
+		c.challenge = "<1896.697170952@relay.test>"
+		return []byte(c.challenge), false, nil
+	}
+	user, digest, _ := strings.Cut(string(resp), " ")
+	mac := hmac.New(md5.New, []byte("secret"))
+	mac.Write([]byte(c.challenge))
+	if user != "user" || digest != hex.EncodeToString(mac.Sum(nil)) {
+		return nil, true, smtp.ErrAuthFailed
+	}
+	return nil, true, c.sess.login("user", "secret")
+}
+
+// startRelay serves a relay on 127.0.0.1, with implicit TLS when implicit is
+// set and STARTTLS otherwise, and returns a client TLS config trusting it.
+func startRelay(t *testing.T, implicit bool) (*relayServer, string, *tls.Config) {
+	t.Helper()
+	serverTLS, err := smtpserver.LoadTLSConfig("", "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(serverTLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	be := &relayServer{}
+	s := smtp.NewServer(be)
+	s.Domain = "relay.test"
+	s.TLSConfig = serverTLS
+	s.EnableAuth(sasl.Login, func(conn *smtp.Conn) sasl.Server {
+		return sasl.NewLoginServer(conn.Session().(*relaySession).login)
+	})
+	s.EnableAuth("CRAM-MD5", func(conn *smtp.Conn) sasl.Server {
+		return &cramMD5Server{sess: conn.Session().(*relaySession)}
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if implicit {
+		ln = tls.NewListener(ln, serverTLS)
+	}
+	go s.Serve(ln)
+	t.Cleanup(func() { s.Close() })
+	return be, ln.Addr().String(), &tls.Config{RootCAs: roots}
+}
+
+func TestDeliver_Relay(t *testing.T) {
+	for _, tc := range []struct {
+		security, auth string
+	}{
+		{RelaySTARTTLS, "plain"},
+		{RelaySTARTTLS, "login"},
+		{RelayTLS, "cram-md5"},
+		{RelayTLS, ""},
+	} {
+		t.Run(tc.security+"/"+tc.auth, func(t *testing.T) {
+			srv, addr, tlsConfig := startRelay(t, tc.security == RelayTLS)
+			c := NewClient("tmp.local")
+			c.SetRelay(&Relay{Addr: addr, Username: "user", Password: "secret", Auth: tc.auth, Security: tc.security, TLSConfig: tlsConfig})
+
+			raw := []byte("Subject: hi\r\n\r\nhello\r\n")
+			if err := c.Deliver(context.Background(), "example.com", "me@tmp.local", []string{"you@example.com"}, raw); err != nil {
+				t.Fatal(err)
+			}
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if len(srv.mails) != 1 {
+				t.Fatalf("relay got %d mails", len(srv.mails))
+			}
+			m := srv.mails[0]
+			if m.user != "user" || m.from != "me@tmp.local" || len(m.to) != 1 || m.to[0] != "you@example.com" || m.body != string(raw) {
+				t.Fatalf("relayed %+v", m)
+			}
+		})
+	}
+}
+
+func TestDeliver_RelayFailures(t *testing.T) {
+	_, addr, tlsConfig := startRelay(t, false)
+	send := func(r *Relay) error {
+		c := NewClient("tmp.local")
+		c.SetRelay(r)
+		return c.Deliver(context.Background(), "example.invalid", "me@tmp.local", []string{"you@example.invalid"}, []byte("\r\nx\r\n"))
+	}
+
+	// Wrong credentials are retried, not bounced.
+	err := send(&Relay{Addr: addr, Username: "user", Password: "wrong", Auth: "plain", TLSConfig: tlsConfig})
+	if err == nil || IsPermanent(err) {
+		t.Fatalf("bad password: %v", err)
+	}
+	// The certificate is verified.
+	if err := send(&Relay{Addr: addr, Username: "user", Password: "secret"}); err == nil {
+		t.Fatal("untrusted certificate accepted")
+	}
+	// No fallback: an unreachable relay fails without trying MX hosts.
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	dead := ln.Addr().String()
+	ln.Close()
+	err = send(&Relay{Addr: dead})
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || strings.Contains(err.Error(), "MX") {
+		t.Fatalf("dead relay: %v", err)
+	}
+	// A relay that never answers is abandoned once ctx expires.
+	hung, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer hung.Close()
+	c := NewClient("tmp.local")
+	c.SetRelay(&Relay{Addr: hung.Addr().String(), Security: RelayNone})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = c.Deliver(ctx, "example.invalid", "me@tmp.local", []string{"you@example.invalid"}, []byte("\r\nx\r\n"))
+	if err == nil || IsPermanent(err) || time.Since(start) > 5*time.Second {
+		t.Fatalf("hung relay: %v after %v", err, time.Since(start))
+	}
+	// With fallback the MX attempt is made and reported too.
+	err = send(&Relay{Addr: dead, Fallback: true})
+	if err == nil || !strings.Contains(err.Error(), "直连 MX 也失败") {
+		t.Fatalf("fallback: %v", err)
+	}
+}
+
+func TestDeliver_RcptErrors(t *testing.T) {
+	srv, addr, tlsConfig := startRelay(t, true)
+	c := NewClient("tmp.local")
+	c.SetRelay(&Relay{Addr: addr, Username: "user", Password: "secret", Security: RelayTLS, TLSConfig: tlsConfig})
+	deliver := func(to ...string) error {
+		return c.Deliver(context.Background(), "example.com", "me@tmp.local", to, []byte("\r\nx\r\n"))
+	}
+
+	// A rejected recipient does not stop the others.
+	err := deliver("nobody@example.com", "you@example.com", "grey@example.com")
+	var rcptErrs RcptErrors
+	if !errors.As(err, &rcptErrs) || len(rcptErrs) != 2 ||
+		!IsPermanent(rcptErrs["nobody@example.com"]) || IsPermanent(rcptErrs["grey@example.com"]) || IsPermanent(err) {
+		t.Fatalf("got %v", err)
+	}
+	srv.mu.Lock()
+	if len(srv.mails) != 1 || strings.Join(srv.mails[0].to, ",") != "you@example.com" {
+		t.Fatalf("relayed %+v", srv.mails)
+	}
+	srv.mu.Unlock()
+
+	// With every recipient rejected no DATA is sent.
+	if err := deliver("nobody@example.com"); !errors.As(err, &rcptErrs) || len(rcptErrs) != 1 {
+		t.Fatalf("got %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.mails) != 1 {
+		t.Fatalf("relay got %d mails", len(srv.mails))
+	}
+}
+
+func TestLoginAuth_RequiresTLS(t *testing.T) {
+	for _, tc := range []struct {
+		host string
+		tls  bool
+		ok   bool
+	}{
+		{"relay.example", true, true},
+		{"relay.example", false, false},
+		{"127.0.0.1", false, true},
+		{"localhost", false, true},
+	} {
+		a := &loginAuth{username: "user", password: "secret", host: tc.host}
+		_, _, err := a.Start(&netsmtp.ServerInfo{Name: tc.host, TLS: tc.tls, Auth: []string{"LOGIN"}})
+		if (err == nil) != tc.ok {
+			t.Errorf("%s tls=%v: got %v", tc.host, tc.tls, err)
+		}
+	}
+	a := &loginAuth{username: "user", password: "secret", host: "relay.example"}
+	if _, _, err := a.Start(&netsmtp.ServerInfo{Name: "other.example", TLS: true}); err == nil {
+		t.Error("wrong host accepted")
+	}
+}
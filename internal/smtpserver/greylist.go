@@ -0,0 +1,113 @@
+package smtpserver
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Greylist configures greylisting: the first delivery attempt of an unknown
+// (client network, MAIL FROM, RCPT) triplet is deferred, and a retry after
+// Delay is accepted and whitelisted.
+type Greylist struct {
+	// Delay is the minimum time before a retry is accepted.
+	Delay time.Duration
+	// WhitelistTTL is how long a triplet stays accepted after its last
+	// delivery.
+	WhitelistTTL time.Duration
+}
+
+// DefaultGreylist waits five minutes and remembers senders for 30 days.
+func DefaultGreylist() Greylist {
+	return Greylist{Delay: 5 * time.Minute, WhitelistTTL: 30 * 24 * time.Hour}
+}
+
+// greylistRetryWindow is how long a deferred triplet waits for its retry
+// before it counts as first sight again.
+const greylistRetryWindow = 24 * time.Hour
+
+var errGreylisted = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Greylisted, please try again later"}
+
+// greylister keeps the pending and whitelisted triplets in memory.
+type greylister struct {
+	cfg     Greylist
+	mu      sync.Mutex
+	pending map[string]time.Time // first attempt
+	passed  map[string]time.Time // whitelisted until
+	sweep   time.Time
+}
+
+func newGreylister(cfg Greylist) *greylister {
+	return &greylister{cfg: cfg, pending: make(map[string]time.Time), passed: make(map[string]time.Time)}
+}
+
+// allow reports whether mail from ip/from to rcpt may be accepted now.
+func (g *greylister) allow(ip, from, rcpt string, now time.Time) bool {
+	key := greylistNet(ip) + "|" + strings.ToLower(from) + "|" + rcpt
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.expire(now)
+	if until, ok := g.passed[key]; ok && now.Before(until) {
+		g.passed[key] = now.Add(g.cfg.WhitelistTTL)
+		return true
+	}
+	first, ok := g.pending[key]
+	if !ok || now.Sub(first) > greylistRetryWindow {
+		g.pending[key] = now
+		return false
+	}
+	if now.Sub(first) < g.cfg.Delay {
+		return false
+	}
+	delete(g.pending, key)
+	g.passed[key] = now.Add(g.cfg.WhitelistTTL)
+	return true
+}
+
+// expire drops stale entries at most once a minute. Callers hold g.mu.
+func (g *greylister) expire(now time.Time) {
+	if now.Sub(g.sweep) < time.Minute {
+		return
+	}
+	g.sweep = now
+	for k, first := range g.pending {
+		if now.Sub(first) > greylistRetryWindow {
+			delete(g.pending, k)
+		}
+	}
+	for k, until := range g.passed {
+		if !now.Before(until) {
+			delete(g.passed, k)
+		}
+	}
+}
+
+// greylistNet reduces a client IP to its /24 (IPv4) or /64 (IPv6) so that
+// retries from another host of the same sending pool still match.
+func greylistNet(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return parsed.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// greylisted applies the greylist to one recipient and logs deferrals.
+func (s *session) greylisted(mailbox string) bool {
+	if s.grey == nil {
+		return false
+	}
+	ip := remoteIP(s.conn.Conn())
+	if s.grey.allow(ip, s.from, mailbox, time.Now()) {
+		return false
+	}
+	log.Printf("smtp: greylist: deferring %s <%s> -> %s", ip, s.from, mailbox)
+	return true
+}
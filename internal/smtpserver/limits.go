@@ -0,0 +1,161 @@
+package smtpserver
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Limits protects the listener from misbehaving senders. Zero values mean
+// no limit.
+type Limits struct {
+	// MaxConnsPerIP caps concurrent connections from one client IP.
+	MaxConnsPerIP int
+	// MessagesPerIP caps MAIL FROM transactions per minute per client IP.
+	MessagesPerIP int
+	// MessagesPerRcpt caps accepted RCPT TO per minute per mailbox.
+	MessagesPerRcpt int
+	// MaxRecipients caps RCPT TO per transaction.
+	MaxRecipients int
+	// IdleTimeout is how long the server waits for the next command.
+	IdleTimeout time.Duration
+	// CommandTimeout bounds a single command including the DATA transfer,
+	// and every reply write.
+	CommandTimeout time.Duration
+}
+
+// DefaultLimits are applied by NewServer.
+func DefaultLimits() Limits {
+	return Limits{
+		MaxConnsPerIP:   10,
+		MessagesPerIP:   60,
+		MessagesPerRcpt: 30,
+		MaxRecipients:   100,
+		IdleTimeout:     5 * time.Minute,
+		CommandTimeout:  10 * time.Minute,
+	}
+}
+
+var (
+	errTooManyConns = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 7, 0}, Message: "Too many connections from your IP, try again later"}
+	errIPRate       = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Too many messages from your IP, slow down"}
+	errRcptRate     = &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Too many messages for this recipient, try again later"}
+	errTooManyRcpts = &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 5, 3}, Message: "Too many recipients"}
+	errDataTimeout  = &smtp.SMTPError{Code: 421, EnhancedCode: smtp.EnhancedCode{4, 4, 2}, Message: "Command timeout, closing connection"}
+)
+
+// rateLimiter counts events per key in fixed one-minute windows.
+type rateLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	hits   map[string]*rateWindow
+	sweep  time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	n     int
+}
+
+func newRateLimiter(perMinute int) *rateLimiter {
+	return &rateLimiter{limit: perMinute, window: time.Minute, hits: make(map[string]*rateWindow)}
+}
+
+// allow records one event for key and reports whether it is within the
+// limit. A nil limiter or a zero limit allows everything.
+func (r *rateLimiter) allow(key string, now time.Time) bool {
+	if r == nil || r.limit <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now.Sub(r.sweep) >= r.window {
+		for k, w := range r.hits {
+			if now.Sub(w.start) >= r.window {
+				delete(r.hits, k)
+			}
+		}
+		r.sweep = now
+	}
+	w := r.hits[key]
+	if w == nil || now.Sub(w.start) >= r.window {
+		w = &rateWindow{start: now}
+		r.hits[key] = w
+	}
+	if w.n >= r.limit {
+		return false
+	}
+	w.n++
+	return true
+}
+
+// connLimiter wraps a listener and refuses connections beyond max per
+// client IP. When reply is set the refusal carries a 421 greeting; on
+// implicit-TLS listeners the connection is just closed.
+type connLimiter struct {
+	net.Listener
+	max   int
+	reply bool
+	mu    sync.Mutex
+	open  map[string]int
+}
+
+func limitConns(ln net.Listener, max int, reply bool) net.Listener {
+	if max <= 0 {
+		return ln
+	}
+	return &connLimiter{Listener: ln, max: max, reply: reply, open: make(map[string]int)}
+}
+
+func (l *connLimiter) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip := remoteIP(c)
+		l.mu.Lock()
+		if l.open[ip] >= l.max {
+			l.mu.Unlock()
+			log.Printf("smtp: limit: %s has %d connections open, refusing", ip, l.max)
+			go l.refuse(c)
+			continue
+		}
+		l.open[ip]++
+		l.mu.Unlock()
+		return &limitedConn{Conn: c, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *connLimiter) refuse(c net.Conn) {
+	defer c.Close()
+	if l.reply {
+		e := errTooManyConns
+		_ = c.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, _ = fmt.Fprintf(c, "%d %d.%d.%d %s\r\n", e.Code, e.EnhancedCode[0], e.EnhancedCode[1], e.EnhancedCode[2], e.Message)
+	}
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.open[ip]--; l.open[ip] <= 0 {
+		delete(l.open, ip)
+	}
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
@@ -0,0 +1,78 @@
+package smtpserver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Recipient modes decide which RCPT TO addresses get a mailbox.
+const (
+	// RecipientsCatchAll accepts every address on a served domain and
+	// creates its mailbox on the fly.
+	RecipientsCatchAll = "catch-all"
+	// RecipientsExisting only accepts mailboxes created through the API.
+	RecipientsExisting = "existing"
+	// RecipientsAllowlist accepts existing mailboxes plus addresses that
+	// match one of the patterns, creating those on the fly.
+	RecipientsAllowlist = "allowlist"
+)
+
+// RecipientPolicy is the RCPT TO acceptance rule. Patterns are path.Match
+// globs matched against the lower-cased full address, or against the local
+// part when the pattern has no "@" (e.g. "test-*" or "*@vanity.io").
+type RecipientPolicy struct {
+	Mode     string
+	Patterns []string
+}
+
+// ParseRecipientPolicy builds a policy from a mode name and a comma separated
+// pattern list.
+func ParseRecipientPolicy(mode, patterns string) (RecipientPolicy, error) {
+	p := RecipientPolicy{Mode: strings.ToLower(strings.TrimSpace(mode))}
+	if p.Mode == "" {
+		p.Mode = RecipientsCatchAll
+	}
+	for _, pat := range strings.Split(patterns, ",") {
+		pat = strings.ToLower(strings.TrimSpace(pat))
+		if pat == "" {
+			continue
+		}
+		if _, err := path.Match(pat, ""); err != nil {
+			return p, fmt.Errorf("bad recipient pattern %q: %v", pat, err)
+		}
+		p.Patterns = append(p.Patterns, pat)
+	}
+	switch p.Mode {
+	case RecipientsCatchAll, RecipientsExisting:
+	case RecipientsAllowlist:
+		if len(p.Patterns) == 0 {
+			return p, fmt.Errorf("recipient mode allowlist needs at least one pattern")
+		}
+	default:
+		return p, fmt.Errorf("unknown recipient mode %q (want catch-all, existing or allowlist)", mode)
+	}
+	return p, nil
+}
+
+// mayCreate reports whether a mailbox that does not exist yet may be created
+// for local@domain.
+func (p RecipientPolicy) mayCreate(local, domain string) bool {
+	switch p.Mode {
+	case RecipientsExisting:
+		return false
+	case RecipientsAllowlist:
+		full := local + "@" + domain
+		for _, pat := range p.Patterns {
+			subject := local
+			if strings.Contains(pat, "@") {
+				subject = full
+			}
+			if ok, _ := path.Match(pat, subject); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
@@ -2,39 +2,53 @@ package smtpserver
 
 import (
 	"bytes"
+	"cmp"
+	"context"
 	"crypto/tls"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
+	"log"
 	"net"
 	stdmail "net/mail"
 	"strings"
 	"sync/atomic"
+	"time"
 
+	"temp_mail/internal/domains"
+	"temp_mail/internal/extract"
+	"temp_mail/internal/mailauth"
+	"temp_mail/internal/mimeparse"
 	"temp_mail/internal/storage"
 
 	"github.com/emersion/go-smtp"
 )
 
+// authTimeout bounds the DNS lookups of SPF, DKIM and DMARC checks.
+const authTimeout = 15 * time.Second
+
 type Server struct {
-	srv    *smtp.Server
-	ln     net.Listener
-	domain string
-	open   atomic.Bool
+	srv  *smtp.Server
+	be   *backend
+	ln   net.Listener
+	open atomic.Bool
 }
 
-func NewServer(store storage.Store, domain string) *Server {
-	be := &backend{store: store, domain: strings.ToLower(domain)}
+// NewServer accepts mail for every domain in reg and greets with the default
+// one.
+func NewServer(store storage.Store, reg *domains.Registry) *Server {
+	be := &backend{store: store, domains: reg}
 	s := smtp.NewServer(be)
-	s.Domain = domain
-	s.ReadTimeout = 0
-	s.WriteTimeout = 0
+	s.Domain = reg.Default().Name
 	s.MaxMessageBytes = 20 * 1024 * 1024
 	s.AllowInsecureAuth = true
-	return &Server{srv: s, domain: domain}
+	srv := &Server{srv: s, be: be}
+	srv.SetLimits(DefaultLimits())
+	return srv
 }
 
+// ListenAndServe accepts plain SMTP on addr, offering STARTTLS when a TLS
+// config is set.
 func (s *Server) ListenAndServe(addr string) error {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
@@ -42,7 +56,21 @@ func (s *Server) ListenAndServe(addr string) error {
 	}
 	s.ln = ln
 	s.open.Store(true)
-	return s.srv.Serve(ln)
+	return s.srv.Serve(limitConns(ln, s.be.limits.MaxConnsPerIP, true))
+}
+
+// ListenAndServeTLS accepts implicit-TLS SMTP (SMTPS, port 465 style) on
+// addr. SetTLSConfig must have been called.
+func (s *Server) ListenAndServeTLS(addr string) error {
+	if s.srv.TLSConfig == nil {
+		return errors.New("smtps: no TLS config")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.open.Store(true)
+	return s.srv.Serve(tls.NewListener(limitConns(ln, s.be.limits.MaxConnsPerIP, false), s.srv.TLSConfig))
 }
 
 func (s *Server) Shutdown() error {
@@ -56,251 +84,285 @@ func (s *Server) Shutdown() error {
 }
 
 type backend struct {
-	store  storage.Store
-	domain string
+	store      storage.Store
+	domains    *domains.Registry
+	recipients RecipientPolicy
+	auth       *mailauth.Verifier
+	limits     Limits
+	ipRate     *rateLimiter
+	rcptRate   *rateLimiter
+	grey       *greylister
 }
 
 func (b *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &session{store: b.store, domain: b.domain}, nil
+	return &session{
+		conn:       c,
+		store:      b.store,
+		domains:    b.domains,
+		recipients: b.recipients,
+		auth:       b.auth,
+		limits:     b.limits,
+		ipRate:     b.ipRate,
+		rcptRate:   b.rcptRate,
+		grey:       b.grey,
+	}, nil
 }
 
 type session struct {
-	store     storage.Store
-	domain    string
-	from      string
-	rcptLocal string
+	// conn is the client connection; after STARTTLS go-smtp starts a new
+	// session on the upgraded connection.
+	conn       *smtp.Conn
+	store      storage.Store
+	domains    *domains.Registry
+	recipients RecipientPolicy
+	auth       *mailauth.Verifier
+	limits     Limits
+	ipRate     *rateLimiter
+	rcptRate   *rateLimiter
+	grey       *greylister
+	from       string
+	// rcpts holds the accepted mailboxes of the current transaction, in
+	// RCPT order and without duplicates.
+	rcpts []string
+	// rcptTo keeps the accepted RCPT TO addresses as the client sent them,
+	// keyed by mailbox, so each stored copy only names its own recipient.
+	rcptTo map[string][]string
+	// nrcpt counts the accepted RCPT TO commands.
+	nrcpt int
 }
 
 func (s *session) AuthPlain(username, password string) error { return nil }
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	if ip := remoteIP(s.conn.Conn()); !s.ipRate.allow(ip, time.Now()) {
+		log.Printf("smtp: limit: %s exceeded %d messages per minute", ip, s.limits.MessagesPerIP)
+		return errIPRate
+	}
 	s.from = from
 	return nil
 }
 func (s *session) Rcpt(to string, _ *smtp.RcptOptions) error {
-	// Accept recipient if domain matches or if no domain provided (catch-all)
+	if max := s.limits.MaxRecipients; max > 0 && s.nrcpt >= max {
+		log.Printf("smtp: limit: %s sent more than %d recipients", remoteIP(s.conn.Conn()), max)
+		return errTooManyRcpts
+	}
+	// Accept recipient if the domain is one of ours; a bare local part means
+	// the default domain
 	addr, err := stdmail.ParseAddress(to)
 	if err != nil {
-		return err
+		return &smtp.SMTPError{
+			Code:         501,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+			Message:      "Bad recipient address syntax",
+		}
 	}
-	parts := strings.Split(addr.Address, "@")
-	local := parts[0]
-	if len(parts) == 2 {
-		dom := strings.ToLower(parts[1])
-		if s.domain != "" && dom != strings.ToLower(s.domain) {
-			return fmt.Errorf("recipient domain not accepted: %s", dom)
+	local, dom := s.domains.Split(addr.Address)
+	d, ok := s.domains.Lookup(dom)
+	if !ok {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 2},
+			Message:      fmt.Sprintf("Recipient domain not accepted: %s", dom),
 		}
 	}
 	// Normalize plus addressing (local+tag)
 	if i := strings.IndexByte(local, '+'); i > 0 {
 		local = local[:i]
 	}
-	s.rcptLocal = s.store.CreateAddress(local)
+	local = strings.ToLower(local)
+	mailbox := local + "@" + dom
+	exists := s.store.AddressExists(mailbox)
+	if !exists && !s.recipients.mayCreate(local, dom) {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "User unknown",
+		}
+	}
+	if !d.NoGreylist && s.greylisted(mailbox) {
+		return errGreylisted
+	}
+	if !s.rcptRate.allow(mailbox, time.Now()) {
+		log.Printf("smtp: limit: %s exceeded %d messages per minute", mailbox, s.limits.MessagesPerRcpt)
+		return errRcptRate
+	}
+	if !exists {
+		s.store.ReserveAddress(mailbox)
+	}
+	s.nrcpt++
+	if s.rcptTo == nil {
+		s.rcptTo = make(map[string][]string)
+	}
+	if _, dup := s.rcptTo[mailbox]; !dup {
+		s.rcpts = append(s.rcpts, mailbox)
+	}
+	s.rcptTo[mailbox] = append(s.rcptTo[mailbox], to)
 	return nil
 }
 func (s *session) Data(r io.Reader) error {
+	if d := s.limits.CommandTimeout; d > 0 {
+		_ = s.conn.Conn().SetReadDeadline(time.Now().Add(d))
+	}
 	buf := new(bytes.Buffer)
 	if _, err := io.Copy(buf, r); err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			log.Printf("smtp: limit: DATA from %s timed out after %v", remoteIP(s.conn.Conn()), s.limits.CommandTimeout)
+			return errDataTimeout
+		}
 		return err
 	}
 	raw := buf.Bytes()
-	// Parse headers using net/mail to get From and Subject
+	// Parse headers and body to get From, Subject and a text snippet
 	var subj string
 	var snippet string
+	var attachments []storage.Attachment
+	var extracted *extract.Result
 	from := s.from
-	dec := new(mime.WordDecoder)
 
-	if msg, err := stdmail.ReadMessage(bytes.NewReader(raw)); err == nil {
-		// Decode MIME encoded subject
-		if rawSubj := msg.Header.Get("Subject"); rawSubj != "" {
-			if decodedSubj, err := dec.DecodeHeader(rawSubj); err == nil {
-				subj = decodedSubj
-			} else {
-				subj = rawSubj
-			}
+	if root, err := mimeparse.Parse(raw); err == nil {
+		if h := root.Header.Get("Subject"); h != "" {
+			subj = mimeparse.DecodeHeader(h)
 		}
-
-		// Decode MIME encoded from
-		if h := msg.Header.Get("From"); h != "" {
-			if decodedFrom, err := dec.DecodeHeader(h); err == nil {
-				from = decodedFrom
-			} else {
-				from = h
-			}
+		if h := root.Header.Get("From"); h != "" {
+			from = mimeparse.DecodeHeader(h)
 		}
-
-		// Extract snippet from body with encoding support
-		contentType := msg.Header.Get("Content-Type")
-		contentTransferEncoding := strings.ToLower(msg.Header.Get("Content-Transfer-Encoding"))
-
-		if b, err := io.ReadAll(msg.Body); err == nil {
-			bodyBytes := b
-			bodyText := ""
-
-			// Handle multipart messages
-			if strings.Contains(contentType, "multipart") {
-				bodyText = extractTextFromMultipart(string(b), contentType)
-			} else {
-				// Decode body if encoded
-				switch contentTransferEncoding {
-				case "base64":
-					bodyStr := strings.ReplaceAll(string(b), "\r\n", "")
-					bodyStr = strings.ReplaceAll(bodyStr, "\n", "")
-					if decoded, err := base64.StdEncoding.DecodeString(bodyStr); err == nil {
-						bodyBytes = decoded
-					}
-				case "quoted-printable":
-					bodyBytes = decodeQuotedPrintableSimple(b)
-				}
-				bodyText = string(bodyBytes)
-			}
-
-			// Clean up text for snippet
-			t := strings.ReplaceAll(bodyText, "\r", "")
-			t = strings.ReplaceAll(t, "\n", " ")
-			t = strings.TrimSpace(t)
-
-			// Remove HTML tags if present
-			if strings.Contains(strings.ToLower(contentType), "html") {
-				t = stripHTMLTags(t)
-			}
-
-			if len(t) > 160 {
-				t = t[:160] + "..."
-			}
-			snippet = t
+		snippet = mimeparse.Snippet(root, 160)
+		attachments = storage.DescribeAttachments(root.Attachments())
+		ex := extract.FromMessage(root, nil)
+		extracted = &ex
+	}
+	tlsState := tlsInfo(s.conn.TLSConnectionState())
+	env := storage.Envelope{
+		MailFrom: s.from,
+		RemoteIP: remoteIP(s.conn.Conn()),
+		Helo:     s.conn.Hostname(),
+	}
+	now := time.Now()
+	by := s.conn.Server().Domain
+	var authResults *mailauth.Results
+	authHeader := ""
+	if s.auth != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), authTimeout)
+		authResults = s.auth.Verify(ctx, net.ParseIP(env.RemoteIP), env.Helo, env.MailFrom, raw)
+		cancel()
+		authHeader = authResults.Header(by)
+	}
+	// Results claiming our authserv-id can only be forged by the sender.
+	raw = mailauth.StripResults(raw, by)
+	// One copy per recipient; the transaction only fails if none was stored.
+	var saveErr error
+	saved := 0
+	for _, rcpt := range s.rcpts {
+		// Other recipients of the transaction (e.g. Bcc) stay hidden.
+		env := env
+		env.RcptTo = s.rcptTo[rcpt]
+		trace := traceHeaders(&env, tlsState, authHeader, rcpt, by, now)
+		if _, err := s.store.Save(rcpt, storage.Message{
+			From:        from,
+			Subject:     subj,
+			Snippet:     snippet,
+			Attachments: attachments,
+			Extract:     extracted,
+			TLS:         tlsState,
+			Envelope:    &env,
+			Auth:        authResults,
+			Raw:         append(trace, raw...),
+		}); err != nil {
+			log.Printf("smtp: save for %s failed: %v", rcpt, err)
+			saveErr = err
+			continue
 		}
+		saved++
 	}
-	_, saveErr := s.store.Save(s.rcptLocal, storage.Message{
-		From:    from,
-		Subject: subj,
-		Snippet: snippet,
-		Raw:     raw,
-	})
-	return saveErr
+	if saved == 0 && saveErr != nil {
+		return smtpError(saveErr)
+	}
+	return nil
 }
-func (s *session) Reset()        {}
-func (s *session) Logout() error { return nil }
 
-// Optional: STARTTLS config placeholder (not used for local dev)
-func (s *Server) SetTLSConfig(cfg *tls.Config) {
-	s.srv.TLSConfig = cfg
+// traceHeaders builds the Return-Path, Delivered-To, Authentication-Results
+// (when authHeader is set) and Received headers prepended to the copy stored
+// for rcpt, as a final delivery MTA would.
+func traceHeaders(env *storage.Envelope, tlsState *storage.TLSInfo, authHeader, rcpt, by string, now time.Time) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "Return-Path: <%s>\r\n", env.MailFrom)
+	fmt.Fprintf(&b, "Delivered-To: %s\r\n", rcpt)
+	b.WriteString(authHeader)
+	fmt.Fprintf(&b, "Received: from %s ([%s])\r\n\tby %s (temp_mail) with ", cmp.Or(env.Helo, "unknown"), env.RemoteIP, by)
+	if tlsState != nil {
+		fmt.Fprintf(&b, "ESMTPS (%s %s)", tlsState.Version, tlsState.Cipher)
+	} else {
+		b.WriteString("ESMTP")
+	}
+	fmt.Fprintf(&b, "\r\n\tfor <%s>; %s\r\n", rcpt, now.Format(time.RFC1123Z))
+	return b.Bytes()
 }
 
-// extractTextFromMultipart extracts plain text from multipart email
-func extractTextFromMultipart(body, contentType string) string {
-	// Extract boundary
-	boundary := ""
-	if idx := strings.Index(contentType, "boundary="); idx >= 0 {
-		boundary = contentType[idx+9:]
-		boundary = strings.Trim(boundary, `"`)
-		if idx2 := strings.IndexAny(boundary, "; \t\r\n"); idx2 >= 0 {
-			boundary = boundary[:idx2]
-		}
+// remoteIP returns the client IP of c without the port.
+func remoteIP(c net.Conn) string {
+	addr := c.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
 	}
+	return addr
+}
 
-	if boundary == "" {
-		return body
+// smtpError turns storage quota errors into the matching SMTP replies; other
+// errors are passed through and reported as 451 by go-smtp.
+func smtpError(err error) error {
+	var qe *storage.QuotaError
+	if !errors.As(err, &qe) {
+		return err
 	}
+	switch {
+	case qe.Scope == storage.ScopeMessage:
+		return &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 3, 4}, Message: "Message too big for mailbox"}
+	case qe.Scope == storage.ScopeStore:
+		return &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 3, 1}, Message: "Insufficient system storage"}
+	case qe.Temporary:
+		return &smtp.SMTPError{Code: 452, EnhancedCode: smtp.EnhancedCode{4, 2, 2}, Message: "Mailbox full, try again later"}
+	default:
+		return &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "Mailbox full"}
+	}
+}
+func (s *session) Reset() {
+	s.from = ""
+	s.rcpts = nil
+	s.rcptTo = nil
+	s.nrcpt = 0
+}
+func (s *session) Logout() error { return nil }
 
-	parts := strings.Split(body, "--"+boundary)
-	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if part == "" || part == "--" {
-			continue
-		}
-
-		// Split headers and body
-		splitIdx := strings.Index(part, "\r\n\r\n")
-		if splitIdx < 0 {
-			splitIdx = strings.Index(part, "\n\n")
-			if splitIdx < 0 {
-				continue
-			}
-			splitIdx += 2
-		} else {
-			splitIdx += 4
-		}
-
-		headers := part[:splitIdx]
-		content := part[splitIdx:]
-
-		// Only process text/plain parts
-		if !strings.Contains(headers, "text/plain") {
-			continue
-		}
-
-		// Decode content based on Content-Transfer-Encoding
-		if strings.Contains(headers, "base64") {
-			content = strings.ReplaceAll(content, "\r\n", "")
-			content = strings.ReplaceAll(content, "\n", "")
-			if decoded, err := base64.StdEncoding.DecodeString(content); err == nil {
-				return string(decoded)
-			}
-		} else if strings.Contains(headers, "quoted-printable") {
-			return string(decodeQuotedPrintableSimple([]byte(content)))
-		}
+// SetRecipientPolicy decides which recipients are accepted; the default is
+// RecipientsCatchAll. Call it before serving.
+func (s *Server) SetRecipientPolicy(p RecipientPolicy) {
+	s.be.recipients = p
+}
 
-		return content
-	}
+// SetLimits replaces the connection, rate and timeout limits; NewServer
+// starts with DefaultLimits. Call it before serving.
+func (s *Server) SetLimits(l Limits) {
+	s.be.limits = l
+	s.be.ipRate = newRateLimiter(l.MessagesPerIP)
+	s.be.rcptRate = newRateLimiter(l.MessagesPerRcpt)
+	s.srv.ReadTimeout = l.IdleTimeout
+	s.srv.WriteTimeout = l.CommandTimeout
+}
 
-	return ""
+// SetGreylist turns greylisting on; domains with NoGreylist are exempt.
+// Call it before serving.
+func (s *Server) SetGreylist(g Greylist) {
+	s.be.grey = newGreylister(g)
 }
 
-// stripHTMLTags removes HTML tags from text
-func stripHTMLTags(s string) string {
-	// Simple HTML tag removal
-	inTag := false
-	var result strings.Builder
-	for _, r := range s {
-		if r == '<' {
-			inTag = true
-			continue
-		}
-		if r == '>' {
-			inTag = false
-			continue
-		}
-		if !inTag {
-			result.WriteRune(r)
-		}
-	}
-	return result.String()
+// SetAuthVerifier turns on SPF, DKIM and DMARC checks for every received
+// message. Call it before serving.
+func (s *Server) SetAuthVerifier(v *mailauth.Verifier) {
+	s.be.auth = v
 }
 
-// decodeQuotedPrintableSimple decodes quoted-printable encoded text
-func decodeQuotedPrintableSimple(data []byte) []byte {
-	var result bytes.Buffer
-	i := 0
-	for i < len(data) {
-		if data[i] == '=' {
-			if i+2 < len(data) {
-				// Soft line break
-				if data[i+1] == '\r' && data[i+2] == '\n' {
-					i += 3
-					continue
-				}
-				if data[i+1] == '\n' {
-					i += 2
-					continue
-				}
-				// Hex encoding
-				if i+2 < len(data) {
-					hex := string(data[i+1 : i+3])
-					var b byte
-					if _, err := fmt.Sscanf(hex, "%02X", &b); err == nil {
-						result.WriteByte(b)
-						i += 3
-						continue
-					}
-				}
-			}
-			// Invalid encoding, keep the =
-			result.WriteByte(data[i])
-			i++
-		} else {
-			result.WriteByte(data[i])
-			i++
-		}
-	}
-	return result.Bytes()
+// SetTLSConfig enables STARTTLS on the plain listener and is required for
+// ListenAndServeTLS. Call it before serving.
+func (s *Server) SetTLSConfig(cfg *tls.Config) {
+	s.srv.TLSConfig = cfg
 }
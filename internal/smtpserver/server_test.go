@@ -0,0 +1,367 @@
+package smtpserver
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"temp_mail/internal/domains"
+	"temp_mail/internal/storage"
+
+	"github.com/emersion/go-smtp"
+)
+
+// startTestServer runs the server on a random local port and returns its address.
+func startTestServer(t *testing.T, srv *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.ln = ln
+	srv.open.Store(true)
+	go srv.srv.Serve(limitConns(ln, srv.be.limits.MaxConnsPerIP, true))
+	t.Cleanup(func() { srv.Shutdown() })
+	return ln.Addr().String()
+}
+
+func testDomains(t *testing.T, names ...string) *domains.Registry {
+	t.Helper()
+	var list []domains.Domain
+	for _, n := range names {
+		list = append(list, domains.Domain{Name: n})
+	}
+	reg, err := domains.New(list...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func TestSession_MultipleRecipients(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	addr := startTestServer(t, NewServer(store, testDomains(t, "tmp.local", "vanity.test")))
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"alice@tmp.local", "bob@vanity.test", "alice+cc@TMP.local"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("rcpt %s: %v", rcpt, err)
+		}
+	}
+	err = c.Rcpt("carol@other.example", nil)
+	if e, ok := err.(*smtp.SMTPError); !ok || e.Code != 550 {
+		t.Fatalf("want 550 for foreign domain, got %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("From: sender@example.com\r\nSubject: group\r\n\r\nhello all\r\n"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, local := range []string{"alice@tmp.local", "bob@vanity.test"} {
+		msgs := store.List(local)
+		if len(msgs) != 1 {
+			t.Fatalf("%s: want 1 message, got %d", local, len(msgs))
+		}
+		if !strings.Contains(msgs[0].Snippet, "hello all") {
+			t.Fatalf("%s: bad snippet %q", local, msgs[0].Snippet)
+		}
+	}
+	if store.AddressExists("carol@other.example") {
+		t.Fatal("rejected recipient must not get a mailbox")
+	}
+}
+
+func TestSession_QuotaReplies(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	store.SetQuota(storage.Quota{MaxMessages: 1, MaxBytes: 1024, Policy: storage.QuotaDefer})
+	addr := startTestServer(t, NewServer(store, testDomains(t, "tmp.local")))
+
+	send := func(body string) error {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.SendMail("sender@example.com", []string{"full@tmp.local"}, strings.NewReader("Subject: q\r\n\r\n"+body+"\r\n"))
+	}
+	if err := send("first"); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{"second", 452},
+		{strings.Repeat(strings.Repeat("x", 70)+"\r\n", 30), 552},
+	} {
+		err := send(c.body)
+		if e, ok := err.(*smtp.SMTPError); !ok || e.Code != c.code {
+			t.Fatalf("want %d, got %v", c.code, err)
+		}
+	}
+}
+
+func TestSession_RecipientPolicy(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	srv := NewServer(store, testDomains(t, "tmp.local", "vanity.test"))
+	policy, err := ParseRecipientPolicy("allowlist", "qa-*, *@vanity.test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetRecipientPolicy(policy)
+	addr := startTestServer(t, srv)
+	store.CreateAddress("known@tmp.local")
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Mail("sender@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		rcpt string
+		ok   bool
+	}{
+		{"known@tmp.local", true},
+		{"qa-signup@tmp.local", true},
+		{"anyone@vanity.test", true},
+		{"stranger@tmp.local", false},
+	}
+	for _, tc := range cases {
+		err := c.Rcpt(tc.rcpt, nil)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.rcpt, err)
+		}
+		if !tc.ok {
+			if e, ok := err.(*smtp.SMTPError); !ok || e.Code != 550 || e.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) {
+				t.Errorf("%s: want 550 5.1.1, got %v", tc.rcpt, err)
+			}
+		}
+	}
+	if store.AddressExists("stranger@tmp.local") {
+		t.Fatal("rejected recipient got a mailbox")
+	}
+
+	if _, err := ParseRecipientPolicy("allowlist", ""); err == nil {
+		t.Fatal("allowlist without patterns accepted")
+	}
+}
+
+func TestSession_RecordsTLS(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	srv := NewServer(store, testDomains(t, "tmp.local"))
+	cfg, err := LoadTLSConfig("", "", "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetTLSConfig(cfg)
+	addr := startTestServer(t, srv)
+
+	send := func(rcpt string, starttls bool) {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if starttls {
+			if err := c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := c.SendMail("sender@example.com", []string{rcpt}, strings.NewReader("Subject: tls\r\n\r\nhi\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	send("secure@tmp.local", true)
+	send("plain@tmp.local", false)
+
+	msgs := store.List("secure@tmp.local")
+	if len(msgs) != 1 || msgs[0].TLS == nil || !strings.HasPrefix(msgs[0].TLS.Version, "TLS 1.") || msgs[0].TLS.Cipher == "" {
+		t.Fatalf("want TLS details on STARTTLS message, got %+v", msgs)
+	}
+	if msgs := store.List("plain@tmp.local"); len(msgs) != 1 || msgs[0].TLS != nil {
+		t.Fatalf("plaintext message must not carry TLS details, got %+v", msgs)
+	}
+}
+
+func TestSession_Envelope(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	addr := startTestServer(t, NewServer(store, testDomains(t, "tmp.local")))
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("mx.sender.example"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMail("bounce@sender.example", []string{"alice@tmp.local", "Alice+tag@tmp.local", "bob@tmp.local"},
+		strings.NewReader("From: Support <support@brand.example>\r\nSubject: env\r\n\r\nbody\r\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := store.List("alice@tmp.local")
+	if len(msgs) != 1 {
+		t.Fatalf("want 1 message, got %d", len(msgs))
+	}
+	env := msgs[0].Envelope
+	if env == nil || env.MailFrom != "bounce@sender.example" || env.Helo != "mx.sender.example" || env.RemoteIP != "127.0.0.1" {
+		t.Fatalf("bad envelope %+v", env)
+	}
+	if len(env.RcptTo) != 2 || env.RcptTo[1] != "Alice+tag@tmp.local" {
+		t.Fatalf("bad rcpt list %v", env.RcptTo)
+	}
+	// Each copy only lists its own recipient.
+	if bob := store.List("bob@tmp.local"); len(bob) != 1 || len(bob[0].Envelope.RcptTo) != 1 || bob[0].Envelope.RcptTo[0] != "bob@tmp.local" {
+		t.Fatalf("bob's copy: %+v", bob)
+	}
+	full, _ := store.Get("alice@tmp.local", msgs[0].ID)
+	raw := string(full.Raw)
+	for _, want := range []string{
+		"Return-Path: <bounce@sender.example>\r\n",
+		"Delivered-To: alice@tmp.local\r\n",
+		"Received: from mx.sender.example ([127.0.0.1])\r\n\tby tmp.local (temp_mail) with ESMTP\r\n\tfor <alice@tmp.local>;",
+	} {
+		if !strings.Contains(raw, want) {
+			t.Errorf("raw lacks %q:\n%s", want, raw)
+		}
+	}
+	if !strings.HasSuffix(raw, "From: Support <support@brand.example>\r\nSubject: env\r\n\r\nbody\r\n") {
+		t.Errorf("original message not kept intact:\n%s", raw)
+	}
+}
+
+func TestSession_Limits(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	srv := NewServer(store, testDomains(t, "tmp.local"))
+	srv.SetLimits(Limits{MaxConnsPerIP: 1, MessagesPerIP: 2, MessagesPerRcpt: 1, MaxRecipients: 2, IdleTimeout: 200 * time.Millisecond})
+	addr := startTestServer(t, srv)
+
+	wantCode := func(step string, err error, code int) {
+		t.Helper()
+		if e, ok := err.(*smtp.SMTPError); !ok || e.Code != code {
+			t.Fatalf("%s: want %d, got %v", step, code, err)
+		}
+	}
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Hello("client.test"); err != nil {
+		t.Fatal(err)
+	}
+	c2, err := smtp.Dial(addr)
+	if err == nil {
+		err = c2.Hello("client.test")
+		c2.Close()
+	}
+	wantCode("second connection", err, 421)
+
+	if err := c.Mail("s@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"a@tmp.local", "b@tmp.local"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantCode("third recipient", c.Rcpt("c@tmp.local", nil), 452)
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("s@example.com", nil); err != nil {
+		t.Fatal(err)
+	}
+	wantCode("recipient rate", c.Rcpt("a@tmp.local", nil), 451)
+	if err := c.Reset(); err != nil {
+		t.Fatal(err)
+	}
+	wantCode("ip rate", c.Mail("s@example.com", nil), 451)
+
+	time.Sleep(400 * time.Millisecond)
+	if err := c.Noop(); err == nil {
+		t.Fatal("idle connection still open")
+	}
+}
+
+func TestGreylister(t *testing.T) {
+	g := newGreylister(Greylist{Delay: time.Minute, WhitelistTTL: time.Hour})
+	t0 := time.Now()
+	steps := []struct {
+		ip   string
+		at   time.Duration
+		want bool
+	}{
+		{"192.0.2.10", 0, false},                // first sight
+		{"192.0.2.10", 30 * time.Second, false}, // retry too early
+		{"192.0.2.99", 2 * time.Minute, true},   // same /24 after the delay
+		{"192.0.2.10", 50 * time.Minute, true},  // whitelisted
+		{"198.51.100.1", 50 * time.Minute, false},
+		{"192.0.2.10", 3 * time.Hour, false}, // whitelist expired
+	}
+	for i, st := range steps {
+		if got := g.allow(st.ip, "Bounce@Sender.example", "a@tmp.local", t0.Add(st.at)); got != st.want {
+			t.Errorf("step %d (%s at %v): got %v, want %v", i, st.ip, st.at, got, st.want)
+		}
+	}
+	if greylistNet("2001:db8::1") != greylistNet("2001:db8::ffff") {
+		t.Error("IPv6 hosts of one /64 should share a greylist entry")
+	}
+}
+
+func TestSession_Greylist(t *testing.T) {
+	store := storage.NewMemoryStore(time.Minute)
+	defer store.Close()
+	reg, err := domains.New(domains.Domain{Name: "tmp.local"}, domains.Domain{Name: "exempt.test", NoGreylist: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(store, reg)
+	srv.SetGreylist(Greylist{WhitelistTTL: time.Hour})
+	addr := startTestServer(t, srv)
+
+	send := func(rcpt string) error {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.SendMail("sender@example.com", []string{rcpt}, strings.NewReader("Subject: grey\r\n\r\nhi\r\n"))
+	}
+	err = send("a@tmp.local")
+	if e, ok := err.(*smtp.SMTPError); !ok || e.Code != 451 || e.EnhancedCode != (smtp.EnhancedCode{4, 7, 1}) {
+		t.Fatalf("first attempt: want 451 4.7.1, got %v", err)
+	}
+	if err := send("a@tmp.local"); err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if err := send("b@exempt.test"); err != nil {
+		t.Fatalf("exempt domain: %v", err)
+	}
+	if len(store.List("a@tmp.local")) != 1 || len(store.List("b@exempt.test")) != 1 {
+		t.Fatal("accepted messages were not stored")
+	}
+}
@@ -0,0 +1,570 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"temp_mail/internal/extract"
+	"temp_mail/internal/mimeparse"
+
+	"github.com/google/uuid"
+)
+
+// maildirIndex and maildirAddress are the sidecar files kept in every
+// mailbox directory: message metadata and the address record. The leading dot
+// keeps them out of the way of Maildir-aware tools.
+const (
+	maildirIndex   = ".index.json"
+	maildirAddress = ".address.json"
+)
+
+// MaildirStore keeps every message as a plain file in a Maildir tree
+// (<root>/<local>/new|cur|tmp) so mailboxes survive restarts and can be
+// inspected, grepped or rsynced with ordinary tools. Metadata lives in a
+// per-mailbox sidecar index and is cached in memory.
+type MaildirStore struct {
+	notifier
+	lifetimes
+	quotas
+	mu       sync.RWMutex
+	root     string
+	ttl      time.Duration
+	hostname string
+	addrs    map[string]Address
+	boxes    map[string]map[string]maildirEntry // addr -> id -> entry
+	stopCh   chan struct{}
+}
+
+type maildirEntry struct {
+	Message
+	// File is relative to the mailbox directory, e.g. "new/1700000000.<id>.host".
+	File string `json:"file"`
+}
+
+// NewMaildirStore opens the Maildir tree at root, creating it if needed, and
+// loads every existing mailbox into memory.
+func NewMaildirStore(root string, ttl time.Duration) (*MaildirStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	host = strings.NewReplacer("/", "_", ":", "_").Replace(host)
+	if host == "" {
+		host = "localhost"
+	}
+	s := &MaildirStore{
+		root:     root,
+		ttl:      ttl,
+		hostname: host,
+		addrs:    make(map[string]Address),
+		boxes:    make(map[string]map[string]maildirEntry),
+		stopCh:   make(chan struct{}),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	go s.gcLoop()
+	return s, nil
+}
+
+// load rebuilds the in-memory cache from disk. Index entries follow their
+// file when a client renames it and are dropped when it has gone; files
+// without an index entry (dropped in by hand or restored from a backup) are
+// picked up with metadata read from their headers.
+func (s *MaildirStore) load() error {
+	dirs, err := os.ReadDir(s.root)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		addr, err := url.PathUnescape(d.Name())
+		if err != nil {
+			log.Printf("maildir: skip %s: %v", d.Name(), err)
+			continue
+		}
+		box := make(map[string]maildirEntry)
+		dir := filepath.Join(s.root, d.Name())
+		// Index entries are matched to files by unique name, so a message a
+		// Maildir client moved from new/ to cur/ keeps its ID and metadata.
+		byName := make(map[string]maildirEntry)
+		if data, err := os.ReadFile(filepath.Join(dir, maildirIndex)); err == nil {
+			var entries []maildirEntry
+			if err := json.Unmarshal(data, &entries); err != nil {
+				log.Printf("maildir: corrupt index for %s: %v", addr, err)
+			}
+			for _, e := range entries {
+				byName[maildirUniq(e.File)] = e
+			}
+		}
+		for _, sub := range []string{"new", "cur"} {
+			files, _ := os.ReadDir(filepath.Join(dir, sub))
+			for _, f := range files {
+				if f.IsDir() {
+					continue
+				}
+				rel := sub + "/" + f.Name()
+				if e, ok := byName[maildirUniq(rel)]; ok {
+					if info, err := f.Info(); err == nil {
+						delete(byName, maildirUniq(rel))
+						e.File = rel
+						e.Size = info.Size()
+						box[e.ID] = e
+						continue
+					}
+				}
+				e, err := s.entryFromFile(dir, rel)
+				if err != nil {
+					log.Printf("maildir: skip %s/%s: %v", addr, rel, err)
+					continue
+				}
+				box[e.ID] = e
+			}
+		}
+		s.boxes[addr] = box
+		if err := s.writeIndex(addr); err != nil {
+			log.Printf("maildir: rewrite index for %s: %v", addr, err)
+		}
+
+		a := Address{Addr: addr}
+		if data, err := os.ReadFile(filepath.Join(dir, maildirAddress)); err == nil {
+			if err := json.Unmarshal(data, &a); err != nil {
+				log.Printf("maildir: corrupt address record for %s: %v", addr, err)
+			}
+			a.Addr = addr
+		}
+		// Records from older versions may lack the token or the expiry; the
+		// lifetime then starts now so an upgrade does not wipe them at once.
+		if a.Token == "" || a.ExpiresAt.IsZero() {
+			if a.Token == "" {
+				a.Token = newToken()
+			}
+			if a.CreatedAt.IsZero() {
+				a.CreatedAt = time.Now()
+			}
+			if a.ExpiresAt.IsZero() {
+				a.ExpiresAt = time.Now().Add(DefaultAddressTTL)
+			}
+			if err := s.writeAddress(a); err != nil {
+				log.Printf("maildir: write address record for %s: %v", addr, err)
+			}
+		}
+		s.addrs[addr] = a
+	}
+	return nil
+}
+
+// maildirUniq returns the unique part of a message file name, without the
+// directory and the ":2,<flags>" info that clients append when moving the
+// file to cur/.
+func maildirUniq(rel string) string {
+	name, _, _ := strings.Cut(filepath.Base(rel), ":")
+	return name
+}
+
+func (s *MaildirStore) entryFromFile(dir, rel string) (maildirEntry, error) {
+	path := filepath.Join(dir, rel)
+	info, err := os.Stat(path)
+	if err != nil {
+		return maildirEntry{}, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return maildirEntry{}, err
+	}
+	e := maildirEntry{File: rel}
+	e.ID = uuid.NewString()
+	e.Size = info.Size()
+	e.CreatedAt = info.ModTime()
+	e.ExpiresAt = e.CreatedAt.Add(s.ttl)
+	if root, err := mimeparse.Parse(raw); err == nil {
+		e.From = mimeparse.DecodeHeader(root.Header.Get("From"))
+		e.Subject = mimeparse.DecodeHeader(root.Header.Get("Subject"))
+		e.Snippet = mimeparse.Snippet(root, 160)
+		e.Attachments = DescribeAttachments(root.Attachments())
+		ex := extract.FromMessage(root, nil)
+		e.Extract = &ex
+	}
+	return e, nil
+}
+
+// dir returns the mailbox directory. Addresses are path-escaped so a crafted
+// local part can never leave the root.
+func (s *MaildirStore) dir(addr string) string {
+	name := url.PathEscape(addr)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	return filepath.Join(s.root, name)
+}
+
+func (s *MaildirStore) ensureDirs(addr string) error {
+	dir := s.dir(addr)
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeIndex must be called with s.mu held (or during load).
+func (s *MaildirStore) writeIndex(addr string) error {
+	entries := make([]maildirEntry, 0, len(s.boxes[addr]))
+	for _, e := range s.boxes[addr] {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := s.dir(addr)
+	tmp := filepath.Join(dir, maildirIndex+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, maildirIndex))
+}
+
+func (s *MaildirStore) writeAddress(a Address) error {
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := s.dir(a.Addr)
+	tmp := filepath.Join(dir, maildirAddress+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, maildirAddress))
+}
+
+func (s *MaildirStore) CreateAddress(addr string) Address {
+	addr = mailboxKey(addr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.ensureAddress(addr, false)
+	if err != nil {
+		log.Printf("maildir: create address %s: %v", addr, err)
+	}
+	return a
+}
+
+func (s *MaildirStore) ReserveAddress(addr string) Address {
+	addr = mailboxKey(addr)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.ensureAddress(addr, true)
+	if err != nil {
+		log.Printf("maildir: reserve address %s: %v", addr, err)
+	}
+	return a
+}
+
+func (s *MaildirStore) ClaimAddress(addr string) (Address, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.addrs[addr]
+	if !ok || !a.Unclaimed {
+		return Address{}, false
+	}
+	a.Unclaimed = false
+	if err := s.writeAddress(a); err != nil {
+		log.Printf("maildir: claim address %s: %v", addr, err)
+		return Address{}, false
+	}
+	s.addrs[addr] = a
+	return a, true
+}
+
+// ensureAddress must be called with s.mu held.
+func (s *MaildirStore) ensureAddress(addr string, unclaimed bool) (Address, error) {
+	if a, ok := s.addrs[addr]; ok {
+		return a, nil
+	}
+	a := newAddress(addr, time.Now(), s.addressTTLFor(addr), unclaimed)
+	if err := s.ensureDirs(addr); err != nil {
+		return a, err
+	}
+	if err := s.writeAddress(a); err != nil {
+		return a, err
+	}
+	s.addrs[addr] = a
+	s.boxes[addr] = make(map[string]maildirEntry)
+	return a, s.writeIndex(addr)
+}
+
+func (s *MaildirStore) GetAddress(addr string) (Address, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.addrs[addr]
+	return a, ok
+}
+
+func (s *MaildirStore) AddressExists(addr string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, exists := s.addrs[addr]
+	return exists
+}
+
+func (s *MaildirStore) ExtendAddress(addr string, d time.Duration) (Address, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, ok := s.addrs[addr]
+	if !ok {
+		return Address{}, false
+	}
+	a.ExpiresAt = extendedExpiry(a, time.Now(), d)
+	if err := s.writeAddress(a); err != nil {
+		log.Printf("maildir: extend address %s: %v", addr, err)
+		return Address{}, false
+	}
+	s.addrs[addr] = a
+	return a, true
+}
+
+func (s *MaildirStore) QualifyLegacy(domain string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for addr, a := range s.addrs {
+		if strings.Contains(addr, "@") {
+			continue
+		}
+		full := addr + "@" + domain
+		if _, taken := s.addrs[full]; taken {
+			log.Printf("maildir: %s and %s both exist, keeping the legacy mailbox as is", addr, full)
+			continue
+		}
+		if err := os.Rename(s.dir(addr), s.dir(full)); err != nil {
+			return err
+		}
+		a.Addr = full
+		s.addrs[full] = a
+		s.boxes[full] = s.boxes[addr]
+		delete(s.addrs, addr)
+		delete(s.boxes, addr)
+		if err := s.writeAddress(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save delivers the message the Maildir way: write into tmp/, then rename
+// into new/ so readers never see a partial file.
+func (s *MaildirStore) Save(addr string, msg Message) (Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.ensureAddress(addr, true); err != nil {
+		return Message{}, err
+	}
+	msg.Size = int64(len(msg.Raw))
+	box := make([]Message, 0, len(s.boxes[addr]))
+	for _, e := range s.boxes[addr] {
+		box = append(box, e.Message)
+	}
+	evict, err := s.Quota().admit(box, msg.Size)
+	if err != nil {
+		return Message{}, err
+	}
+	if msg.ID == "" {
+		msg.ID = uuid.NewString()
+	}
+	now := time.Now()
+	msg.CreatedAt = now
+	msg.ExpiresAt = now.Add(s.messageTTLFor(addr, s.ttl))
+
+	name := fmt.Sprintf("%d.%s.%s", now.Unix(), msg.ID, s.hostname)
+	dir := s.dir(addr)
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg.Raw, 0o644); err != nil {
+		return Message{}, err
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, "new", name)); err != nil {
+		_ = os.Remove(tmp)
+		return Message{}, err
+	}
+
+	// Evict only once the new message is safely on disk, so a failed write
+	// does not cost the mailbox its oldest mail.
+	for _, id := range evict {
+		old := s.boxes[addr][id]
+		if err := os.Remove(filepath.Join(dir, old.File)); err != nil && !os.IsNotExist(err) {
+			log.Printf("maildir: evict %s/%s: %v", addr, id, err)
+			continue
+		}
+		delete(s.boxes[addr], id)
+	}
+	e := maildirEntry{Message: msg, File: "new/" + name}
+	e.Raw = nil
+	s.boxes[addr][msg.ID] = e
+	if err := s.writeIndex(addr); err != nil {
+		return Message{}, err
+	}
+	s.publish(addr, msg)
+	return msg, nil
+}
+
+func (s *MaildirStore) Usage(addr string) (Usage, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.addrs[addr]; !ok {
+		return Usage{}, false
+	}
+	box := make([]Message, 0, len(s.boxes[addr]))
+	for _, e := range s.boxes[addr] {
+		box = append(box, e.Message)
+	}
+	return usageOf(box, s.Quota()), true
+}
+
+func (s *MaildirStore) List(addr string) []Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Message
+	for _, e := range s.boxes[addr] {
+		out = append(out, s.readMessage(addr, e))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+func (s *MaildirStore) Get(addr, id string) (Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.boxes[addr][id]
+	if !ok {
+		return Message{}, false
+	}
+	return s.readMessage(addr, e), true
+}
+
+func (s *MaildirStore) readMessage(addr string, e maildirEntry) Message {
+	msg := e.Message
+	raw, err := os.ReadFile(filepath.Join(s.dir(addr), e.File))
+	if err != nil {
+		log.Printf("maildir: read %s/%s: %v", addr, e.File, err)
+	}
+	msg.Raw = raw
+	return msg
+}
+
+func (s *MaildirStore) Delete(addr, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.boxes[addr][id]
+	if !ok {
+		return false
+	}
+	if err := os.Remove(filepath.Join(s.dir(addr), e.File)); err != nil && !os.IsNotExist(err) {
+		log.Printf("maildir: remove %s/%s: %v", addr, e.File, err)
+		return false
+	}
+	delete(s.boxes[addr], id)
+	if err := s.writeIndex(addr); err != nil {
+		log.Printf("maildir: write index for %s: %v", addr, err)
+	}
+	return true
+}
+
+func (s *MaildirStore) DeleteAll(addr string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for id, e := range s.boxes[addr] {
+		if err := os.Remove(filepath.Join(s.dir(addr), e.File)); err != nil && !os.IsNotExist(err) {
+			log.Printf("maildir: remove %s/%s: %v", addr, e.File, err)
+			continue
+		}
+		delete(s.boxes[addr], id)
+		n++
+	}
+	if n > 0 {
+		if err := s.writeIndex(addr); err != nil {
+			log.Printf("maildir: write index for %s: %v", addr, err)
+		}
+	}
+	return n
+}
+
+func (s *MaildirStore) DeleteAddress(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.addrs[addr]; !ok {
+		return false
+	}
+	if err := os.RemoveAll(s.dir(addr)); err != nil {
+		log.Printf("maildir: remove mailbox %s: %v", addr, err)
+		return false
+	}
+	delete(s.boxes, addr)
+	delete(s.addrs, addr)
+	return true
+}
+
+// PurgeExpired deletes expired message files and removes the directories of
+// expired mailboxes.
+func (s *MaildirStore) PurgeExpired() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for addr, a := range s.addrs {
+		if now.After(a.ExpiresAt) {
+			if err := os.RemoveAll(s.dir(addr)); err != nil {
+				log.Printf("maildir: remove mailbox %s: %v", addr, err)
+				continue
+			}
+			delete(s.boxes, addr)
+			delete(s.addrs, addr)
+		}
+	}
+	for addr, box := range s.boxes {
+		changed := false
+		for id, e := range box {
+			if now.After(e.ExpiresAt) {
+				if err := os.Remove(filepath.Join(s.dir(addr), e.File)); err != nil && !os.IsNotExist(err) {
+					log.Printf("maildir: remove %s/%s: %v", addr, e.File, err)
+					continue
+				}
+				delete(box, id)
+				changed = true
+			}
+		}
+		if changed {
+			if err := s.writeIndex(addr); err != nil {
+				log.Printf("maildir: write index for %s: %v", addr, err)
+			}
+		}
+	}
+}
+
+func (s *MaildirStore) TTL() time.Duration { return s.ttl }
+
+func (s *MaildirStore) gcLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.PurgeExpired()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *MaildirStore) Close() {
+	close(s.stopCh)
+}
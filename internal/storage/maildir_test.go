@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaildirStore_SaveReload(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewMaildirStore(root, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.CreateAddress("test").Addr
+	saved, err := s.Save(addr, Message{From: "a@b", Subject: "hello", Raw: []byte("Subject: hello\r\n\r\nworld")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	files, _ := os.ReadDir(filepath.Join(root, "test", "new"))
+	if len(files) != 1 {
+		t.Fatalf("want 1 file in new/, got %d", len(files))
+	}
+	// A message dropped into the tree by hand is picked up on reload.
+	extra := []byte("From: ops@example.com\r\nSubject: restored\r\n\r\nbody")
+	if err := os.WriteFile(filepath.Join(root, "test", "cur", "1.restored.host:2,S"), extra, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewMaildirStore(root, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if len(s.List(addr)) != 2 {
+		t.Fatalf("want 2 after reload, got %d", len(s.List(addr)))
+	}
+	got, ok := s.Get(addr, saved.ID)
+	if !ok || got.Subject != "hello" || string(got.Raw) != "Subject: hello\r\n\r\nworld" {
+		t.Fatalf("bad message: %+v", got)
+	}
+}
+
+func TestMaildirStore_ReloadAfterClientMove(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewMaildirStore(root, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := s.CreateAddress("moved").Addr
+	saved, err := s.Save(addr, Message{
+		Subject:  "hello",
+		Raw:      []byte("Subject: hello\r\n\r\nworld"),
+		Envelope: &Envelope{MailFrom: "a@b", RcptTo: []string{addr}, RemoteIP: "192.0.2.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// A Maildir client marks the message seen: new/<name> -> cur/<name>:2,S.
+	files, _ := os.ReadDir(filepath.Join(root, "moved", "new"))
+	if len(files) != 1 {
+		t.Fatalf("want 1 file in new/, got %d", len(files))
+	}
+	name := files[0].Name()
+	if err := os.Rename(filepath.Join(root, "moved", "new", name), filepath.Join(root, "moved", "cur", name+":2,S")); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewMaildirStore(root, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := len(s.List(addr)); n != 1 {
+		t.Fatalf("want 1 after reload, got %d", n)
+	}
+	got, ok := s.Get(addr, saved.ID)
+	if !ok || got.Envelope == nil || got.Envelope.RemoteIP != "192.0.2.1" || string(got.Raw) != "Subject: hello\r\n\r\nworld" {
+		t.Fatalf("bad message after move: %+v", got)
+	}
+}
+
+func TestMaildirStore_TTL(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewMaildirStore(root, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetAddressTTL(300 * time.Millisecond)
+	addr := s.CreateAddress("ttl").Addr
+	_, _ = s.Save(addr, Message{Subject: "x", Raw: []byte("x")})
+	time.Sleep(150 * time.Millisecond)
+	s.PurgeExpired()
+	if len(s.List(addr)) != 0 {
+		t.Fatal("expected expired")
+	}
+	if !s.AddressExists(addr) {
+		t.Fatal("empty address purged before its own expiry")
+	}
+	time.Sleep(200 * time.Millisecond)
+	s.PurgeExpired()
+	if _, err := os.Stat(filepath.Join(root, "ttl")); !os.IsNotExist(err) {
+		t.Fatal("expected mailbox directory to be removed")
+	}
+}
+
+func TestMaildirStore_EvictAfterWrite(t *testing.T) {
+	s, err := NewMaildirStore(t.TempDir(), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetQuota(Quota{MaxMessages: 1, Policy: QuotaEvict})
+	addr := s.CreateAddress("full").Addr
+	old, err := s.Save(addr, Message{Raw: []byte("old")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed write must leave the message it would have evicted alone.
+	tmp := filepath.Join(s.dir(addr), "tmp")
+	if err := os.RemoveAll(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tmp, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Save(addr, Message{Raw: []byte("new")}); err == nil {
+		t.Fatal("save into a broken maildir succeeded")
+	}
+	if _, ok := s.Get(addr, old.ID); !ok {
+		t.Fatal("oldest message evicted although the new one was not stored")
+	}
+}
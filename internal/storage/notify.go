@@ -0,0 +1,54 @@
+package storage
+
+import "sync"
+
+// subscriberBuffer is how many undelivered messages a slow subscriber may
+// fall behind before further notifications are dropped for it.
+const subscriberBuffer = 16
+
+// notifier is the pub/sub hook shared by the Store implementations. Save
+// publishes every stored message to the subscribers of its address.
+type notifier struct {
+	mu   sync.Mutex
+	subs map[string]map[chan Message]struct{}
+}
+
+// Subscribe returns a channel that receives every message saved to addr from
+// now on, and a function that cancels the subscription.
+func (n *notifier) Subscribe(addr string) (<-chan Message, func()) {
+	ch := make(chan Message, subscriberBuffer)
+	n.mu.Lock()
+	if n.subs == nil {
+		n.subs = make(map[string]map[chan Message]struct{})
+	}
+	if n.subs[addr] == nil {
+		n.subs[addr] = make(map[chan Message]struct{})
+	}
+	n.subs[addr][ch] = struct{}{}
+	n.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			n.mu.Lock()
+			delete(n.subs[addr], ch)
+			if len(n.subs[addr]) == 0 {
+				delete(n.subs, addr)
+			}
+			n.mu.Unlock()
+		})
+	}
+}
+
+// publish never blocks: a subscriber whose buffer is full misses the event
+// and is expected to catch up through List.
+func (n *notifier) publish(addr string, msg Message) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.subs[addr] {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Quota policies decide what Save does when a message does not fit.
+const (
+	// QuotaEvict drops the oldest messages of the mailbox until it fits.
+	QuotaEvict = "evict"
+	// QuotaDefer refuses the message with a temporary error so the sender
+	// retries later.
+	QuotaDefer = "defer"
+	// QuotaReject refuses the message permanently.
+	QuotaReject = "reject"
+)
+
+// Quota limits a single mailbox. Zero values mean unlimited.
+type Quota struct {
+	MaxMessages int
+	MaxBytes    int64
+	Policy      string
+}
+
+// Usage is what a mailbox currently holds, with the limits it is held to.
+type Usage struct {
+	Messages    int   `json:"messages"`
+	Bytes       int64 `json:"bytes"`
+	MaxMessages int   `json:"maxMessages,omitempty"`
+	MaxBytes    int64 `json:"maxBytes,omitempty"`
+}
+
+// Quota error scopes.
+const (
+	ScopeMessage = "message" // the message alone exceeds a limit
+	ScopeMailbox = "mailbox" // the mailbox is full
+	ScopeStore   = "store"   // the store as a whole is full
+)
+
+// QuotaError is returned by Save when a message is refused for lack of room.
+type QuotaError struct {
+	Scope     string
+	Temporary bool
+}
+
+func (e *QuotaError) Error() string {
+	if e.Scope == ScopeMessage {
+		return "message exceeds quota"
+	}
+	return fmt.Sprintf("%s quota exceeded", e.Scope)
+}
+
+// quotas holds the quota setting shared by the Store implementations.
+type quotas struct {
+	quota Quota
+}
+
+// SetQuota sets the per-mailbox limits. Call it before the store is used.
+func (q *quotas) SetQuota(quota Quota) { q.quota = quota }
+
+func (q *quotas) Quota() Quota { return q.quota }
+
+// messageSize is the size a message is accounted with.
+func messageSize(m Message) int64 {
+	if m.Raw != nil {
+		return int64(len(m.Raw))
+	}
+	return m.Size
+}
+
+// usageOf sums the sizes of msgs.
+func usageOf(msgs []Message, q Quota) Usage {
+	u := Usage{Messages: len(msgs), MaxMessages: q.MaxMessages, MaxBytes: q.MaxBytes}
+	for _, m := range msgs {
+		u.Bytes += messageSize(m)
+	}
+	return u
+}
+
+// admit decides whether a message of size bytes fits into a mailbox holding
+// msgs. Under QuotaEvict it returns the IDs of the oldest messages to drop
+// first; otherwise any overflow is a *QuotaError.
+func (q Quota) admit(msgs []Message, size int64) ([]string, error) {
+	if q.MaxBytes > 0 && size > q.MaxBytes {
+		return nil, &QuotaError{Scope: ScopeMessage}
+	}
+	u := usageOf(msgs, q)
+	fits := func() bool {
+		return (q.MaxMessages <= 0 || u.Messages+1 <= q.MaxMessages) &&
+			(q.MaxBytes <= 0 || u.Bytes+size <= q.MaxBytes)
+	}
+	if fits() {
+		return nil, nil
+	}
+	switch q.Policy {
+	case QuotaDefer:
+		return nil, &QuotaError{Scope: ScopeMailbox, Temporary: true}
+	case QuotaReject:
+		return nil, &QuotaError{Scope: ScopeMailbox}
+	}
+	return evictOldest(msgs, func(m Message) bool {
+		u.Messages--
+		u.Bytes -= messageSize(m)
+		return fits()
+	}), nil
+}
+
+// evictOldest walks msgs oldest first, calling drop for each until it
+// reports that enough room was made, and returns the IDs it went through.
+func evictOldest(msgs []Message, drop func(Message) bool) []string {
+	sorted := append([]Message(nil), msgs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].CreatedAt.Before(sorted[j].CreatedAt) })
+	var ids []string
+	for _, m := range sorted {
+		ids = append(ids, m.ID)
+		if drop(m) {
+			break
+		}
+	}
+	return ids
+}
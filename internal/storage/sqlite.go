@@ -0,0 +1,474 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS addresses (
+	local      TEXT PRIMARY KEY, -- full address; the name predates multi-domain
+	created_at INTEGER NOT NULL,
+	token      TEXT NOT NULL DEFAULT '',
+	expires_at INTEGER NOT NULL DEFAULT 0,
+	unclaimed  INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS messages (
+	id         TEXT PRIMARY KEY,
+	address    TEXT NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	data       TEXT NOT NULL,
+	raw        BLOB
+);
+CREATE INDEX IF NOT EXISTS idx_messages_address ON messages(address, created_at);
+CREATE INDEX IF NOT EXISTS idx_messages_expires ON messages(expires_at);
+`
+
+// sqliteIndexes reference columns added by migrateSQLite, so they are
+// created after it ran.
+const sqliteIndexes = `
+CREATE INDEX IF NOT EXISTS idx_addresses_expires ON addresses(expires_at);
+`
+
+// SQLiteStore persists addresses and messages in an embedded SQLite database
+// so mailboxes survive restarts. Message metadata is kept as JSON next to the
+// raw MIME, only the columns needed for lookups and expiry are broken out.
+type SQLiteStore struct {
+	notifier
+	lifetimes
+	quotas
+	db     *sql.DB
+	ttl    time.Duration
+	stopCh chan struct{}
+}
+
+// NewSQLiteStore opens (or creates) the database at path. path may be a plain
+// file path or a "file:" URI understood by the sqlite driver.
+func NewSQLiteStore(path string, ttl time.Duration) (*SQLiteStore, error) {
+	dsn := path
+	if !strings.HasPrefix(dsn, "file:") {
+		dsn = "file:" + dsn
+	}
+	if !strings.Contains(dsn, "_pragma=") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	}
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite serialises writers anyway; a single connection avoids SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteIndexes); err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &SQLiteStore{
+		db:     db,
+		ttl:    ttl,
+		stopCh: make(chan struct{}),
+	}
+	go s.gcLoop()
+	return s, nil
+}
+
+// migrateSQLite brings databases created by older versions up to the
+// current schema.
+func migrateSQLite(db *sql.DB) error {
+	cols, err := sqliteColumns(db, "addresses")
+	if err != nil {
+		return err
+	}
+	if !cols["token"] {
+		if _, err := db.Exec(`ALTER TABLE addresses ADD COLUMN token TEXT NOT NULL DEFAULT ''`); err != nil {
+			return err
+		}
+	}
+	// Addresses from before tokens existed get one now.
+	rows, err := db.Query(`SELECT local FROM addresses WHERE token = ''`)
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for rows.Next() {
+		var addr string
+		if err := rows.Scan(&addr); err != nil {
+			rows.Close()
+			return err
+		}
+		missing = append(missing, addr)
+	}
+	rows.Close()
+	for _, addr := range missing {
+		if _, err := db.Exec(`UPDATE addresses SET token = ? WHERE local = ?`, newToken(), addr); err != nil {
+			return err
+		}
+	}
+	if !cols["expires_at"] {
+		if _, err := db.Exec(`ALTER TABLE addresses ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	if !cols["unclaimed"] {
+		if _, err := db.Exec(`ALTER TABLE addresses ADD COLUMN unclaimed INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return err
+		}
+	}
+	// Addresses from before they had their own lifetime get the default one,
+	// counted from now so an upgrade does not wipe them at once.
+	_, err = db.Exec(`UPDATE addresses SET expires_at = ? WHERE expires_at = 0`,
+		time.Now().Add(DefaultAddressTTL).UnixNano())
+	return err
+}
+
+func sqliteColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info(?)`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cols := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		cols[name] = true
+	}
+	return cols, rows.Err()
+}
+
+func (s *SQLiteStore) CreateAddress(addr string) Address {
+	return s.createAddress(addr, false)
+}
+
+func (s *SQLiteStore) ReserveAddress(addr string) Address {
+	return s.createAddress(addr, true)
+}
+
+func (s *SQLiteStore) createAddress(addr string, unclaimed bool) Address {
+	addr = mailboxKey(addr)
+	if err := insertAddress(s.db, newAddress(addr, time.Now(), s.addressTTLFor(addr), unclaimed)); err != nil {
+		log.Printf("sqlite: create address %s: %v", addr, err)
+		return Address{Addr: addr}
+	}
+	a, _ := s.GetAddress(addr)
+	return a
+}
+
+func (s *SQLiteStore) ClaimAddress(addr string) (Address, bool) {
+	res, err := s.db.Exec(`UPDATE addresses SET unclaimed = 0 WHERE local = ? AND unclaimed = 1`, addr)
+	if err != nil {
+		log.Printf("sqlite: claim address %s: %v", addr, err)
+		return Address{}, false
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		return Address{}, false
+	}
+	return s.GetAddress(addr)
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// insertAddress stores a unless the address already exists.
+func insertAddress(db execer, a Address) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO addresses(local, created_at, token, expires_at, unclaimed) VALUES(?, ?, ?, ?, ?)`,
+		a.Addr, a.CreatedAt.UnixNano(), a.Token, a.ExpiresAt.UnixNano(), a.Unclaimed)
+	return err
+}
+
+func (s *SQLiteStore) GetAddress(addr string) (Address, bool) {
+	a := Address{Addr: addr}
+	var created, expires int64
+	err := s.db.QueryRow(`SELECT token, created_at, expires_at, unclaimed FROM addresses WHERE local = ?`, addr).
+		Scan(&a.Token, &created, &expires, &a.Unclaimed)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get address %s: %v", addr, err)
+		}
+		return Address{}, false
+	}
+	a.CreatedAt = time.Unix(0, created)
+	a.ExpiresAt = time.Unix(0, expires)
+	return a, true
+}
+
+func (s *SQLiteStore) ExtendAddress(addr string, d time.Duration) (Address, bool) {
+	a, ok := s.GetAddress(addr)
+	if !ok {
+		return Address{}, false
+	}
+	a.ExpiresAt = extendedExpiry(a, time.Now(), d)
+	if _, err := s.db.Exec(`UPDATE addresses SET expires_at = ? WHERE local = ?`, a.ExpiresAt.UnixNano(), addr); err != nil {
+		log.Printf("sqlite: extend address %s: %v", addr, err)
+		return Address{}, false
+	}
+	return a, true
+}
+
+func (s *SQLiteStore) AddressExists(addr string) bool {
+	var n int
+	err := s.db.QueryRow(`SELECT 1 FROM addresses WHERE local = ?`, addr).Scan(&n)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("sqlite: address exists %s: %v", addr, err)
+	}
+	return err == nil
+}
+
+func (s *SQLiteStore) QualifyLegacy(domain string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	suffix := "@" + domain
+	// Rows whose qualified name is already taken stay behind untouched.
+	if _, err := tx.Exec(`UPDATE OR IGNORE addresses SET local = local || ? WHERE instr(local, '@') = 0`, suffix); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE messages SET address = address || ?
+		WHERE instr(address, '@') = 0 AND address NOT IN (SELECT local FROM addresses)`, suffix); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) Save(addr string, msg Message) (Message, error) {
+	if msg.ID == "" {
+		msg.ID = uuid.NewString()
+	}
+	if msg.Raw != nil {
+		msg.Size = int64(len(msg.Raw))
+	}
+	now := time.Now()
+	msg.CreatedAt = now
+	msg.ExpiresAt = now.Add(s.messageTTLFor(addr, s.ttl))
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return Message{}, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Message{}, err
+	}
+	defer tx.Rollback()
+	if err := insertAddress(tx, newAddress(addr, now, s.addressTTLFor(addr), true)); err != nil {
+		return Message{}, err
+	}
+	box, err := sizesOf(tx, addr)
+	if err != nil {
+		return Message{}, err
+	}
+	evict, err := s.Quota().admit(box, msg.Size)
+	if err != nil {
+		return Message{}, err
+	}
+	for _, id := range evict {
+		if _, err := tx.Exec(`DELETE FROM messages WHERE id = ?`, id); err != nil {
+			return Message{}, err
+		}
+	}
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO messages(id, address, created_at, expires_at, data, raw) VALUES(?, ?, ?, ?, ?, ?)`,
+		msg.ID, addr, msg.CreatedAt.UnixNano(), msg.ExpiresAt.UnixNano(), string(data), msg.Raw); err != nil {
+		return Message{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Message{}, err
+	}
+	s.publish(addr, msg)
+	return msg, nil
+}
+
+type querier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// sizesOf returns the messages of addr with only ID, CreatedAt and Size
+// filled in, which is all quota accounting needs.
+func sizesOf(db querier, addr string) ([]Message, error) {
+	rows, err := db.Query(`SELECT id, created_at, length(raw) FROM messages WHERE address = ?`, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Message
+	for rows.Next() {
+		var (
+			m       Message
+			created int64
+			size    sql.NullInt64
+		)
+		if err := rows.Scan(&m.ID, &created, &size); err != nil {
+			return nil, err
+		}
+		m.CreatedAt = time.Unix(0, created)
+		m.Size = size.Int64
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+func (s *SQLiteStore) Usage(addr string) (Usage, bool) {
+	if !s.AddressExists(addr) {
+		return Usage{}, false
+	}
+	box, err := sizesOf(s.db, addr)
+	if err != nil {
+		log.Printf("sqlite: usage %s: %v", addr, err)
+		return Usage{}, false
+	}
+	return usageOf(box, s.Quota()), true
+}
+
+func (s *SQLiteStore) List(addr string) []Message {
+	rows, err := s.db.Query(`SELECT data, raw FROM messages WHERE address = ? ORDER BY created_at DESC`, addr)
+	if err != nil {
+		log.Printf("sqlite: list %s: %v", addr, err)
+		return nil
+	}
+	defer rows.Close()
+	var out []Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			log.Printf("sqlite: list %s: %v", addr, err)
+			continue
+		}
+		out = append(out, msg)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("sqlite: list %s: %v", addr, err)
+	}
+	return out
+}
+
+func (s *SQLiteStore) Get(addr, id string) (Message, bool) {
+	row := s.db.QueryRow(`SELECT data, raw FROM messages WHERE address = ? AND id = ?`, addr, id)
+	msg, err := scanMessage(row)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("sqlite: get %s/%s: %v", addr, id, err)
+		}
+		return Message{}, false
+	}
+	return msg, true
+}
+
+func (s *SQLiteStore) Delete(addr, id string) bool {
+	res, err := s.db.Exec(`DELETE FROM messages WHERE address = ? AND id = ?`, addr, id)
+	if err != nil {
+		log.Printf("sqlite: delete %s/%s: %v", addr, id, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (s *SQLiteStore) DeleteAll(addr string) int {
+	res, err := s.db.Exec(`DELETE FROM messages WHERE address = ?`, addr)
+	if err != nil {
+		log.Printf("sqlite: delete all %s: %v", addr, err)
+		return 0
+	}
+	n, _ := res.RowsAffected()
+	return int(n)
+}
+
+func (s *SQLiteStore) DeleteAddress(addr string) bool {
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("sqlite: delete address %s: %v", addr, err)
+		return false
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM messages WHERE address = ?`, addr); err != nil {
+		log.Printf("sqlite: delete address %s: %v", addr, err)
+		return false
+	}
+	res, err := tx.Exec(`DELETE FROM addresses WHERE local = ?`, addr)
+	if err != nil {
+		log.Printf("sqlite: delete address %s: %v", addr, err)
+		return false
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("sqlite: delete address %s: %v", addr, err)
+		return false
+	}
+	n, _ := res.RowsAffected()
+	return n > 0
+}
+
+func (s *SQLiteStore) PurgeExpired() {
+	now := time.Now().UnixNano()
+	if _, err := s.db.Exec(`DELETE FROM messages WHERE expires_at < ?
+		OR address IN (SELECT local FROM addresses WHERE expires_at < ?)`, now, now); err != nil {
+		log.Printf("sqlite: purge messages: %v", err)
+		return
+	}
+	if _, err := s.db.Exec(`DELETE FROM addresses WHERE expires_at < ?`, now); err != nil {
+		log.Printf("sqlite: purge addresses: %v", err)
+	}
+}
+
+func (s *SQLiteStore) TTL() time.Duration { return s.ttl }
+
+func (s *SQLiteStore) gcLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.PurgeExpired()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+func (s *SQLiteStore) Close() {
+	close(s.stopCh)
+	if err := s.db.Close(); err != nil {
+		log.Printf("sqlite: close: %v", err)
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row rowScanner) (Message, error) {
+	var (
+		data string
+		raw  []byte
+		msg  Message
+	)
+	if err := row.Scan(&data, &raw); err != nil {
+		return Message{}, err
+	}
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		return Message{}, err
+	}
+	msg.Raw = raw
+	return msg, nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStore_SaveListGet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.db")
+	s, err := NewSQLiteStore(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := s.CreateAddress("test")
+	addr := created.Addr
+	saved, err := s.Save(addr, Message{From: "a@b", Subject: "hello", Snippet: "world", Raw: []byte("Subject: hello\r\n\r\nworld")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	// Reopen to make sure everything came from disk.
+	s, err = NewSQLiteStore(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if a, ok := s.GetAddress(addr); !ok || a.Token != created.Token || a.Token == "" || !a.ExpiresAt.Equal(created.ExpiresAt) {
+		t.Fatalf("address lost after reopen: %+v", a)
+	}
+	list := s.List(addr)
+	if len(list) != 1 {
+		t.Fatalf("want 1, got %d", len(list))
+	}
+	got, ok := s.Get(addr, saved.ID)
+	if !ok {
+		t.Fatal("not found")
+	}
+	if got.Subject != "hello" || string(got.Raw) != "Subject: hello\r\n\r\nworld" {
+		t.Fatalf("bad message: %+v", got)
+	}
+}
+
+func TestSQLiteStore_TTL(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "mail.db"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetAddressTTL(300 * time.Millisecond)
+	addr := s.CreateAddress("ttl").Addr
+	_, _ = s.Save(addr, Message{Subject: "x"})
+	time.Sleep(150 * time.Millisecond)
+	s.PurgeExpired()
+	if len(s.List(addr)) != 0 {
+		t.Fatal("expected expired")
+	}
+	if !s.AddressExists(addr) {
+		t.Fatal("empty address purged before its own expiry")
+	}
+	time.Sleep(200 * time.Millisecond)
+	s.PurgeExpired()
+	if s.AddressExists(addr) {
+		t.Fatal("expected expired address to be purged")
+	}
+}
+
+func TestSQLiteStore_QualifyLegacy(t *testing.T) {
+	s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "mail.db"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	old := s.CreateAddress("old")
+	saved, _ := s.Save("old", Message{Subject: "x"})
+
+	if err := s.QualifyLegacy("tmp.local"); err != nil {
+		t.Fatal(err)
+	}
+	if s.AddressExists("old") {
+		t.Fatal("legacy key still present")
+	}
+	a, ok := s.GetAddress("old@tmp.local")
+	if !ok || a.Token != old.Token {
+		t.Fatalf("qualified address: %+v %v", a, ok)
+	}
+	if _, ok := s.Get("old@tmp.local", saved.ID); !ok {
+		t.Fatal("messages did not follow their address")
+	}
+}
@@ -1,50 +1,260 @@
 package storage
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"math/big"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"temp_mail/internal/extract"
+	"temp_mail/internal/mailauth"
+	"temp_mail/internal/mimeparse"
+
 	"github.com/google/uuid"
 )
 
 type Message struct {
-	ID        string    `json:"id"`
-	Address   string    `json:"address"`
-	From      string    `json:"from"`
-	Subject   string    `json:"subject"`
-	Snippet   string    `json:"snippet"`
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	From    string `json:"from"`
+	Subject string `json:"subject"`
+	Snippet string `json:"snippet"`
+	// Size of Raw in bytes, the amount counted against quotas.
+	Size      int64     `json:"size"`
 	CreatedAt time.Time `json:"createdAt"`
 	ExpiresAt time.Time `json:"expiresAt"`
+	// Attachments in the order they appear in Raw; the index is the {n} of
+	// the attachment download endpoint.
+	Attachments []Attachment `json:"attachments,omitempty"`
+	// Extract holds the OTP codes and links found in the body on receipt.
+	Extract *extract.Result `json:"extract,omitempty"`
+	// TLS is set when the message arrived over an encrypted SMTP
+	// connection and is omitted for plaintext.
+	TLS *TLSInfo `json:"tls,omitempty"`
+	// Envelope is the SMTP transaction the message arrived in; nil for
+	// messages stored before it was recorded.
+	Envelope *Envelope `json:"envelope,omitempty"`
+	// Auth holds the SPF, DKIM and DMARC results when verification is on.
+	Auth *mailauth.Results `json:"auth,omitempty"`
 	// Raw MIME for full fetch
 	Raw []byte `json:"-"`
 }
 
+// TLSInfo records the protocol version and cipher suite of the SMTP
+// connection a message was received on.
+type TLSInfo struct {
+	Version string `json:"version"`
+	Cipher  string `json:"cipher"`
+}
+
+// Envelope records the SMTP envelope and connection of a received message,
+// which may differ from what its headers claim.
+type Envelope struct {
+	// MailFrom is the MAIL FROM reverse path, empty for bounces.
+	MailFrom string `json:"mailFrom"`
+	// RcptTo lists the accepted RCPT TO addresses as the client sent them.
+	RcptTo   []string `json:"rcptTo"`
+	RemoteIP string   `json:"remoteIP"`
+	// Helo is the name the client gave in HELO/EHLO.
+	Helo string `json:"helo"`
+}
+
+// Attachment describes one attachment of a stored message. The content
+// itself is re-extracted from Message.Raw on download.
+type Attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+	SHA256      string `json:"sha256"`
+}
+
+// DescribeAttachments builds the attachment metadata for parsed parts.
+func DescribeAttachments(parts []*mimeparse.Part) []Attachment {
+	var out []Attachment
+	for _, p := range parts {
+		sum := sha256.Sum256(p.Body)
+		out = append(out, Attachment{
+			Filename:    p.Filename(),
+			ContentType: p.MediaType,
+			Size:        len(p.Body),
+			SHA256:      hex.EncodeToString(sum[:]),
+		})
+	}
+	return out
+}
+
+// Address is a mailbox record. Token is the secret that grants read access to
+// the mailbox through the HTTP API. The address and its remaining messages
+// are purged once ExpiresAt has passed, whether or not mail ever arrived.
+type Address struct {
+	// Addr is the full address, local@domain, and the key of the mailbox.
+	Addr      string    `json:"address"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	// Unclaimed marks a mailbox created by incoming mail rather than through
+	// the API: nobody has its token yet, and the first ClaimAddress hands it
+	// out.
+	Unclaimed bool `json:"unclaimed,omitempty"`
+}
+
+// DefaultAddressTTL is the address lifetime used until SetAddressTTL is
+// called.
+const DefaultAddressTTL = 24 * time.Hour
+
+func newAddress(addr string, now time.Time, ttl time.Duration, unclaimed bool) Address {
+	return Address{Addr: addr, Token: newToken(), CreatedAt: now, ExpiresAt: now.Add(ttl), Unclaimed: unclaimed}
+}
+
+// DomainTTL overrides the store lifetimes for the mailboxes of one domain.
+// Zero fields keep the store default.
+type DomainTTL struct {
+	Message time.Duration
+	Address time.Duration
+}
+
+// lifetimes holds the lifetime settings shared by the Store implementations.
+type lifetimes struct {
+	addressTTL time.Duration
+	domains    map[string]DomainTTL
+}
+
+// SetAddressTTL sets how long new addresses live. Call it before the store
+// is used.
+func (l *lifetimes) SetAddressTTL(d time.Duration) { l.addressTTL = d }
+
+func (l *lifetimes) AddressTTL() time.Duration {
+	if l.addressTTL <= 0 {
+		return DefaultAddressTTL
+	}
+	return l.addressTTL
+}
+
+// SetDomainTTL overrides the lifetimes for addresses ending in @domain. Call
+// it before the store is used.
+func (l *lifetimes) SetDomainTTL(domain string, t DomainTTL) {
+	if l.domains == nil {
+		l.domains = make(map[string]DomainTTL)
+	}
+	l.domains[strings.ToLower(domain)] = t
+}
+
+func (l *lifetimes) addressTTLFor(addr string) time.Duration {
+	if t := l.domains[domainOf(addr)]; t.Address > 0 {
+		return t.Address
+	}
+	return l.AddressTTL()
+}
+
+func (l *lifetimes) messageTTLFor(addr string, def time.Duration) time.Duration {
+	if t := l.domains[domainOf(addr)]; t.Message > 0 {
+		return t.Message
+	}
+	return def
+}
+
+// domainOf returns the lower-cased domain of a mailbox key.
+func domainOf(addr string) string {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		return strings.ToLower(addr[i+1:])
+	}
+	return ""
+}
+
+// mailboxKey fills in a random local part when addr has none ("" or
+// "@domain").
+func mailboxKey(addr string) string {
+	if addr == "" || addr[0] == '@' {
+		return uuidToBase36() + addr
+	}
+	return addr
+}
+
+// extendedExpiry is the new expiry of a after extending it by d from now. It
+// never shortens the current lifetime.
+func extendedExpiry(a Address, now time.Time, d time.Duration) time.Time {
+	if exp := now.Add(d); exp.After(a.ExpiresAt) {
+		return exp
+	}
+	return a.ExpiresAt
+}
+
 type Store interface {
-	CreateAddress(local string) string
-	AddressExists(local string) bool
+	// Mailboxes are keyed by their full address, local@domain.
+
+	// CreateAddress returns the existing record for addr, or creates one
+	// with a fresh token. An empty local part ("@domain") gets a random name.
+	CreateAddress(addr string) Address
+	// ReserveAddress is CreateAddress for mailboxes created outside the
+	// API, such as by incoming mail: a new record is unclaimed. Save
+	// reserves the address it saves to.
+	ReserveAddress(addr string) Address
+	// ClaimAddress marks an unclaimed addr as claimed and returns it so that
+	// its token is handed out once. ok is false when addr does not exist or
+	// was claimed already.
+	ClaimAddress(addr string) (Address, bool)
+	GetAddress(addr string) (Address, bool)
+	AddressExists(addr string) bool
+	// ExtendAddress moves the expiry of addr to d from now, unless it is
+	// already later.
+	ExtendAddress(addr string, d time.Duration) (Address, bool)
 	Save(addr string, msg Message) (Message, error)
 	List(addr string) []Message
 	Get(addr, id string) (Message, bool)
+	// Delete removes one message and reports whether it existed.
+	Delete(addr, id string) bool
+	// DeleteAll empties a mailbox but keeps the address, returning how many
+	// messages were removed.
+	DeleteAll(addr string) int
+	// DeleteAddress removes the address together with its messages.
+	DeleteAddress(addr string) bool
+	// Usage reports how much of its quota a mailbox uses.
+	Usage(addr string) (Usage, bool)
+	// Subscribe delivers every message saved to addr after the call until
+	// the returned cancel func is called.
+	Subscribe(addr string) (<-chan Message, func())
+	// PurgeExpired drops expired messages and expired addresses along with
+	// everything they still hold.
 	PurgeExpired()
+	// TTL is the lifetime of a message.
 	TTL() time.Duration
+	SetAddressTTL(d time.Duration)
+	AddressTTL() time.Duration
+	SetDomainTTL(domain string, t DomainTTL)
+	SetQuota(q Quota)
+	Quota() Quota
 	Close()
 }
 
+// LegacyQualifier is implemented by the persistent stores. Mailboxes created
+// before multi-domain support are keyed by their local part alone;
+// QualifyLegacy appends @domain to those keys.
+type LegacyQualifier interface {
+	QualifyLegacy(domain string) error
+}
+
 type MemoryStore struct {
-	mu       sync.RWMutex
-	ttl      time.Duration
-	messages map[string]map[string]Message // addr -> id -> message
-	stopCh   chan struct{}
+	notifier
+	lifetimes
+	quotas
+	mu        sync.RWMutex
+	ttl       time.Duration
+	maxBytes  int64 // ceiling for all mailboxes together, 0 for none
+	addresses map[string]Address
+	messages  map[string]map[string]Message // addr -> id -> message
+	stopCh    chan struct{}
 }
 
 func NewMemoryStore(ttl time.Duration) *MemoryStore {
 	ms := &MemoryStore{
-		ttl:      ttl,
-		messages: make(map[string]map[string]Message),
-		stopCh:   make(chan struct{}),
+		ttl:       ttl,
+		addresses: make(map[string]Address),
+		messages:  make(map[string]map[string]Message),
+		stopCh:    make(chan struct{}),
 	}
 	go ms.gcLoop()
 	return ms
@@ -98,41 +308,182 @@ func uuidToBase36() string {
 	return result
 }
 
-func (m *MemoryStore) CreateAddress(local string) string {
-	if local == "" {
-		local = uuidToBase36()
+// newToken returns a random 128-bit mailbox token in hex.
+func newToken() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand never fails on supported platforms; fall back anyway.
+		return strings.ReplaceAll(uuid.NewString(), "-", "")
 	}
+	return hex.EncodeToString(b[:])
+}
+
+func (m *MemoryStore) CreateAddress(addr string) Address {
+	addr = mailboxKey(addr)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ensureAddress(addr, false)
+}
+
+func (m *MemoryStore) ReserveAddress(addr string) Address {
+	addr = mailboxKey(addr)
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.messages[local]; !ok {
-		m.messages[local] = make(map[string]Message)
+	return m.ensureAddress(addr, true)
+}
+
+func (m *MemoryStore) ClaimAddress(addr string) (Address, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.addresses[addr]
+	if !ok || !a.Unclaimed {
+		return Address{}, false
+	}
+	a.Unclaimed = false
+	m.addresses[addr] = a
+	return a, true
+}
+
+// ensureAddress must be called with m.mu held.
+func (m *MemoryStore) ensureAddress(addr string, unclaimed bool) Address {
+	a, ok := m.addresses[addr]
+	if !ok {
+		a = newAddress(addr, time.Now(), m.addressTTLFor(addr), unclaimed)
+		m.addresses[addr] = a
+	}
+	if _, ok := m.messages[addr]; !ok {
+		m.messages[addr] = make(map[string]Message)
 	}
-	return local
+	return a
+}
+
+func (m *MemoryStore) GetAddress(addr string) (Address, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.addresses[addr]
+	return a, ok
 }
 
-func (m *MemoryStore) AddressExists(local string) bool {
+func (m *MemoryStore) AddressExists(addr string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	_, exists := m.messages[local]
+	_, exists := m.addresses[addr]
 	return exists
 }
 
+func (m *MemoryStore) ExtendAddress(addr string, d time.Duration) (Address, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a, ok := m.addresses[addr]
+	if !ok {
+		return Address{}, false
+	}
+	a.ExpiresAt = extendedExpiry(a, time.Now(), d)
+	m.addresses[addr] = a
+	return a, true
+}
+
+// SetMemoryLimit caps the bytes held by all mailboxes together. Once it is
+// reached Save evicts the oldest messages store-wide under QuotaEvict and
+// refuses with a temporary error otherwise.
+func (m *MemoryStore) SetMemoryLimit(n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxBytes = n
+}
+
 func (m *MemoryStore) Save(addr string, msg Message) (Message, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	if _, ok := m.messages[addr]; !ok {
-		m.messages[addr] = make(map[string]Message)
+	m.ensureAddress(addr, true)
+	if msg.Raw != nil {
+		msg.Size = int64(len(msg.Raw))
+	}
+	if err := m.makeRoom(addr, msg.Size); err != nil {
+		return Message{}, err
 	}
 	if msg.ID == "" {
 		msg.ID = uuid.NewString()
 	}
 	now := time.Now()
 	msg.CreatedAt = now
-	msg.ExpiresAt = now.Add(m.ttl)
+	msg.ExpiresAt = now.Add(m.messageTTLFor(addr, m.ttl))
 	m.messages[addr][msg.ID] = msg
+	m.publish(addr, msg)
 	return msg, nil
 }
 
+// makeRoom applies the mailbox quota and the memory limit to a message of
+// size bytes about to be saved to addr. Nothing is evicted unless the message
+// is going to be accepted. It must be called with m.mu held.
+func (m *MemoryStore) makeRoom(addr string, size int64) error {
+	q := m.Quota()
+	box := make([]Message, 0, len(m.messages[addr]))
+	for _, msg := range m.messages[addr] {
+		box = append(box, msg)
+	}
+	evict, err := q.admit(box, size)
+	if err != nil {
+		return err
+	}
+	dropped := make(map[string]bool, len(evict))
+	for _, id := range evict {
+		dropped[id] = true
+	}
+
+	var storeEvict [][2]string // addr, id
+	if m.maxBytes > 0 {
+		if size > m.maxBytes {
+			return &QuotaError{Scope: ScopeMessage}
+		}
+		var all []Message
+		owner := make(map[string]string) // id -> addr
+		var total int64
+		for a, msgs := range m.messages {
+			for _, msg := range msgs {
+				if a == addr && dropped[msg.ID] {
+					continue
+				}
+				total += messageSize(msg)
+				all = append(all, msg)
+				owner[msg.ID] = a
+			}
+		}
+		if total+size > m.maxBytes {
+			if q.Policy != "" && q.Policy != QuotaEvict {
+				return &QuotaError{Scope: ScopeStore, Temporary: true}
+			}
+			for _, id := range evictOldest(all, func(msg Message) bool {
+				total -= messageSize(msg)
+				return total+size <= m.maxBytes
+			}) {
+				storeEvict = append(storeEvict, [2]string{owner[id], id})
+			}
+		}
+	}
+
+	for _, id := range evict {
+		delete(m.messages[addr], id)
+	}
+	for _, e := range storeEvict {
+		delete(m.messages[e[0]], e[1])
+	}
+	return nil
+}
+
+func (m *MemoryStore) Usage(addr string) (Usage, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if _, ok := m.addresses[addr]; !ok {
+		return Usage{}, false
+	}
+	box := make([]Message, 0, len(m.messages[addr]))
+	for _, msg := range m.messages[addr] {
+		box = append(box, msg)
+	}
+	return usageOf(box, m.Quota()), true
+}
+
 func (m *MemoryStore) List(addr string) []Message {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -158,19 +509,53 @@ func (m *MemoryStore) Get(addr, id string) (Message, bool) {
 	return msg, true
 }
 
+func (m *MemoryStore) Delete(addr, id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.messages[addr][id]; !ok {
+		return false
+	}
+	delete(m.messages[addr], id)
+	return true
+}
+
+func (m *MemoryStore) DeleteAll(addr string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := len(m.messages[addr])
+	if _, ok := m.messages[addr]; ok {
+		m.messages[addr] = make(map[string]Message)
+	}
+	return n
+}
+
+func (m *MemoryStore) DeleteAddress(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.addresses[addr]; !ok {
+		return false
+	}
+	delete(m.addresses, addr)
+	delete(m.messages, addr)
+	return true
+}
+
 func (m *MemoryStore) PurgeExpired() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	now := time.Now()
-	for addr, msgs := range m.messages {
+	for addr, a := range m.addresses {
+		if now.After(a.ExpiresAt) {
+			delete(m.addresses, addr)
+			delete(m.messages, addr)
+		}
+	}
+	for _, msgs := range m.messages {
 		for id, msg := range msgs {
 			if now.After(msg.ExpiresAt) {
 				delete(msgs, id)
 			}
 		}
-		if len(msgs) == 0 {
-			delete(m.messages, addr)
-		}
 	}
 }
 
@@ -1,6 +1,9 @@
 package storage
 
 import (
+	"errors"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -9,7 +12,7 @@ func TestMemoryStore_SaveListGet(t *testing.T) {
 	ms := NewMemoryStore(500 * time.Millisecond)
 	defer ms.Close()
 
-	addr := ms.CreateAddress("test")
+	addr := ms.CreateAddress("test").Addr
 	saved, err := ms.Save(addr, Message{From: "a@b", Subject: "hello", Snippet: "world"})
 	if err != nil {
 		t.Fatal(err)
@@ -35,7 +38,7 @@ func TestMemoryStore_SaveListGet(t *testing.T) {
 func TestMemoryStore_TTL(t *testing.T) {
 	ms := NewMemoryStore(100 * time.Millisecond)
 	defer ms.Close()
-	addr := ms.CreateAddress("ttl")
+	addr := ms.CreateAddress("ttl").Addr
 	_, _ = ms.Save(addr, Message{Subject: "x"})
 	time.Sleep(150 * time.Millisecond)
 	ms.PurgeExpired()
@@ -43,3 +46,241 @@ func TestMemoryStore_TTL(t *testing.T) {
 		t.Fatal("expected expired")
 	}
 }
+
+func TestMemoryStore_AddressLifetime(t *testing.T) {
+	ms := NewMemoryStore(time.Minute)
+	defer ms.Close()
+	ms.SetAddressTTL(100 * time.Millisecond)
+
+	a := ms.CreateAddress("life")
+	if got := a.ExpiresAt.Sub(a.CreatedAt); got != 100*time.Millisecond {
+		t.Fatalf("lifetime %v", got)
+	}
+	// An empty mailbox survives GC until it expires.
+	ms.PurgeExpired()
+	if !ms.AddressExists("life") {
+		t.Fatal("empty address purged early")
+	}
+
+	ext, ok := ms.ExtendAddress("life", time.Hour)
+	if !ok || !ext.ExpiresAt.After(a.ExpiresAt) {
+		t.Fatalf("extend: %+v %v", ext, ok)
+	}
+	if again, _ := ms.ExtendAddress("life", time.Millisecond); !again.ExpiresAt.Equal(ext.ExpiresAt) {
+		t.Fatal("extend shortened the lifetime")
+	}
+
+	ms.CreateAddress("short")
+	_, _ = ms.Save("short", Message{Subject: "x"})
+	time.Sleep(150 * time.Millisecond)
+	ms.PurgeExpired()
+	if ms.AddressExists("short") || len(ms.List("short")) != 0 {
+		t.Fatal("expired address and its messages should be purged")
+	}
+	if !ms.AddressExists("life") {
+		t.Fatal("extended address purged")
+	}
+}
+
+func TestMemoryStore_DomainTTL(t *testing.T) {
+	ms := NewMemoryStore(time.Minute)
+	defer ms.Close()
+	ms.SetDomainTTL("short.test", DomainTTL{Message: time.Second, Address: time.Hour})
+
+	a := ms.CreateAddress("@short.test")
+	if !strings.HasSuffix(a.Addr, "@short.test") || len(a.Addr) <= len("@short.test") {
+		t.Fatalf("random local part not filled in: %q", a.Addr)
+	}
+	if got := a.ExpiresAt.Sub(a.CreatedAt); got != time.Hour {
+		t.Fatalf("address lifetime %v", got)
+	}
+	m, _ := ms.Save(a.Addr, Message{})
+	if got := m.ExpiresAt.Sub(m.CreatedAt); got != time.Second {
+		t.Fatalf("message lifetime %v", got)
+	}
+	other, _ := ms.Save("x@long.test", Message{})
+	if got := other.ExpiresAt.Sub(other.CreatedAt); got != time.Minute {
+		t.Fatalf("default message lifetime %v", got)
+	}
+}
+
+func TestMemoryStore_Subscribe(t *testing.T) {
+	ms := NewMemoryStore(time.Minute)
+	defer ms.Close()
+
+	ch, cancel := ms.Subscribe("sub")
+	other, cancelOther := ms.Subscribe("other")
+	defer cancelOther()
+
+	saved, _ := ms.Save("sub", Message{Subject: "ping"})
+	select {
+	case got := <-ch:
+		if got.ID != saved.ID {
+			t.Fatalf("got %s, want %s", got.ID, saved.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no notification")
+	}
+	select {
+	case <-other:
+		t.Fatal("notification leaked to another address")
+	default:
+	}
+
+	cancel()
+	_, _ = ms.Save("sub", Message{Subject: "after cancel"})
+	select {
+	case <-ch:
+		t.Fatal("notification after cancel")
+	default:
+	}
+}
+
+// allStores returns a constructor for every Store implementation, keyed by
+// driver name, for tests that must hold for all of them.
+func allStores() map[string]func(t *testing.T) Store {
+	return map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return NewMemoryStore(time.Minute) },
+		"sqlite": func(t *testing.T) Store {
+			s, err := NewSQLiteStore(filepath.Join(t.TempDir(), "mail.db"), time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+		"maildir": func(t *testing.T) Store {
+			s, err := NewMaildirStore(t.TempDir(), time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+}
+
+func TestStores_Delete(t *testing.T) {
+	for name, open := range allStores() {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			addr := s.CreateAddress("del").Addr
+			a, _ := s.Save(addr, Message{Subject: "a", Raw: []byte("Subject: a\r\n\r\na")})
+			_, _ = s.Save(addr, Message{Subject: "b", Raw: []byte("Subject: b\r\n\r\nb")})
+			_, _ = s.Save(addr, Message{Subject: "c", Raw: []byte("Subject: c\r\n\r\nc")})
+
+			if !s.Delete(addr, a.ID) || s.Delete(addr, a.ID) {
+				t.Fatal("Delete should succeed once")
+			}
+			if _, ok := s.Get(addr, a.ID); ok {
+				t.Fatal("deleted message still readable")
+			}
+			if n := s.DeleteAll(addr); n != 2 {
+				t.Fatalf("DeleteAll removed %d, want 2", n)
+			}
+			if len(s.List(addr)) != 0 || !s.AddressExists(addr) {
+				t.Fatal("DeleteAll should empty the mailbox and keep the address")
+			}
+			if !s.DeleteAddress(addr) || s.AddressExists(addr) {
+				t.Fatal("DeleteAddress did not remove the address")
+			}
+			if s.DeleteAddress(addr) {
+				t.Fatal("DeleteAddress reported success for a missing address")
+			}
+		})
+	}
+}
+
+func TestStores_QuotaEvictsOldest(t *testing.T) {
+	for name, open := range allStores() {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			s.SetQuota(Quota{MaxMessages: 2, MaxBytes: 25, Policy: QuotaEvict})
+			var ids []string
+			for _, raw := range []string{"0123456789", "0123456789", "0123456789"} {
+				m, err := s.Save("q", Message{Raw: []byte(raw)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, m.ID)
+				time.Sleep(2 * time.Millisecond)
+			}
+			if _, ok := s.Get("q", ids[0]); ok {
+				t.Fatal("oldest message not evicted")
+			}
+			u, _ := s.Usage("q")
+			if u.Messages != 2 || u.Bytes != 20 {
+				t.Fatalf("usage %+v", u)
+			}
+			if _, err := s.Save("q", Message{Raw: make([]byte, 30)}); err == nil {
+				t.Fatal("message larger than the quota accepted")
+			}
+		})
+	}
+}
+
+func TestStores_Claim(t *testing.T) {
+	for name, open := range allStores() {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			r := s.ReserveAddress("in@tmp.local")
+			if !r.Unclaimed || r.Token == "" {
+				t.Fatalf("reserved %+v", r)
+			}
+			if a := s.CreateAddress("in@tmp.local"); a.Token != r.Token || !a.Unclaimed {
+				t.Fatalf("CreateAddress changed a reserved address: %+v", a)
+			}
+			a, ok := s.ClaimAddress("in@tmp.local")
+			if !ok || a.Token != r.Token || a.Unclaimed {
+				t.Fatalf("claim: %+v %v", a, ok)
+			}
+			if _, ok := s.ClaimAddress("in@tmp.local"); ok {
+				t.Fatal("claimed twice")
+			}
+			if a, _ := s.GetAddress("in@tmp.local"); a.Unclaimed {
+				t.Fatal("claim not stored")
+			}
+			s.CreateAddress("api@tmp.local")
+			if _, ok := s.ClaimAddress("api@tmp.local"); ok {
+				t.Fatal("claimed an address created through the API")
+			}
+			_, _ = s.Save("saved@tmp.local", Message{Subject: "x"})
+			if a, _ := s.GetAddress("saved@tmp.local"); !a.Unclaimed {
+				t.Fatal("Save should reserve the address it creates")
+			}
+		})
+	}
+}
+
+func TestMemoryStore_QuotaPolicies(t *testing.T) {
+	ms := NewMemoryStore(time.Minute)
+	defer ms.Close()
+
+	ms.SetQuota(Quota{MaxMessages: 1, Policy: QuotaDefer})
+	_, _ = ms.Save("a", Message{Raw: []byte("x")})
+	_, err := ms.Save("a", Message{Raw: []byte("y")})
+	var qe *QuotaError
+	if !errors.As(err, &qe) || qe.Scope != ScopeMailbox || !qe.Temporary {
+		t.Fatalf("defer: %v", err)
+	}
+
+	ms.SetQuota(Quota{MaxMessages: 1, Policy: QuotaReject})
+	if _, err := ms.Save("a", Message{Raw: []byte("y")}); !errors.As(err, &qe) || qe.Temporary {
+		t.Fatalf("reject: %v", err)
+	}
+
+	// The memory limit applies across mailboxes.
+	ms.SetQuota(Quota{})
+	ms.SetMemoryLimit(3)
+	b, _ := ms.Save("b", Message{Raw: []byte("yy")})
+	if _, err := ms.Save("c", Message{Raw: []byte("zz")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(ms.List("a")) != 0 {
+		t.Fatal("oldest message store-wide should be evicted first")
+	}
+	if _, ok := ms.Get("b", b.ID); ok {
+		t.Fatal("second oldest message should be evicted too")
+	}
+}